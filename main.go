@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 	"wander-wallet-tools/config"
 	"wander-wallet-tools/logger"
+	"wander-wallet-tools/migrations"
 	"wander-wallet-tools/models"
 	"wander-wallet-tools/services"
 
 	"cloud.google.com/go/bigquery"
-	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
 	"googlemaps.github.io/maps"
 )
 
@@ -20,6 +27,47 @@ func main() {
 	ctx := context.Background()
 	cfg := config.NewConfig(models.Dev)
 
+	command := "enrich"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	// Commands that do not talk to Firestore run before the clients are created
+	if command == "analyze-offline" {
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		dataFile := flags.String("data", services.DefaultCostOfLivingDataFile, "cost-of-living CSV export")
+		mappingFile := flags.String("column-mapping", services.DefaultColumnMappingFile, "CSV mapping the export's columns to metrics")
+		output := flags.String("output", services.DefaultOfflineAnalysisPrefix, "prefix of the CSV and JSON files written")
+		diff := flags.Bool("diff", false, "compare the two JSON analyzer configurations given as arguments instead")
+		analyzerOptions := analyzerFlags(flags)
+		flags.Parse(commandArgs())
+
+		colData, err := services.LoadCostOfLivingCSV(*dataFile, *mappingFile)
+		if err != nil {
+			logger.LogFatalLn("Failed to load cost-of-living data", err)
+		}
+
+		if *diff {
+			args := flags.Args()
+			if len(args) != 2 {
+				logger.LogFatalLn("Usage: analyze-offline --diff <config-a.json> <config-b.json>", nil)
+			}
+			analysisA := services.NewCostOfLivingAnalyzerService(nil, configOptions(args[0])).AnalyzeData(colData)
+			analysisB := services.NewCostOfLivingAnalyzerService(nil, configOptions(args[1])).AnalyzeData(colData)
+			_, err = services.DiffAnalyses(colData, analysisA, analysisB, *output)
+			if err != nil {
+				logger.LogFatalLn("Failed to compare analyzer configurations", err)
+			}
+			return
+		}
+
+		analysis := services.NewCostOfLivingAnalyzerService(nil, analyzerOptions()).AnalyzeData(colData)
+		if err := services.WriteOfflineAnalysis(*output, colData, analysis); err != nil {
+			logger.LogFatalLn("Failed to write offline analysis", err)
+		}
+		return
+	}
+
 	fbApp, err := services.NewFirebaseApp(ctx)
 	if err != nil {
 		logger.LogFatalLn("Firebase failed to initialize", err)
@@ -48,59 +96,328 @@ func main() {
 	// cleanupService := services.NewCostOfLivingCleanupService(fsClient)
 	// cleanupService.CleanupCostOfLivingData(ctx)
 
-	// migrationService := services.NewCostOfLivingMigrationService(fsClient)
-	// migrationService.MigrateCostOfLivingData(ctx)
-
-	// analyzerService := services.NewCostOfLivingAnalyzerService(fsClient)
-	// err = analyzerService.AnalyzeAndStoreData(ctx)
-	// if err != nil {
-	// 	logger.LogFatalLn("Failed to analyze and store data: %v", err)
-	// }
 	// topDestService := services.NewTopDestinationsService(fsClient)
 	// err = topDestService.ProcessAndSaveTopDestinations(ctx)
 	// if err != nil {
 	// 	logger.LogFatalLn("Failed to process and save top destinations: %v", err)
 	// }
 
-	enrichService := services.NewTopDestinationEnrichmentService(bqClient, fsClient, cfg, mapsClient)
-	err = enrichService.EnrichTopDestinations(ctx)
-	if err != nil {
-		logger.LogFatalLn("Failed to enrich top destinations: %v", err)
+	switch command {
+	case "migrate-cost-of-living":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		resume := flags.Bool("resume", false, "continue from the last saved checkpoint")
+		maxOpsPerSecond := flags.Float64("max-ops-per-second", 0, "write throughput ceiling (0 for no ceiling)")
+		flags.Parse(commandArgs())
+
+		writerOptions := services.DefaultBulkWriterOptions()
+		writerOptions.MaxOpsPerSecond = *maxOpsPerSecond
+
+		migrationService := services.NewCostOfLivingMigrationService(fsClient)
+		err = migrationService.MigrateCostOfLivingData(ctx, *resume, writerOptions)
+		if err != nil {
+			logger.LogFatalLn("Failed to migrate cost-of-living data", err)
+		}
+	case "export":
+		args := commandArgs()
+		if len(args) != 2 {
+			logger.LogFatalLn("Usage: export <collection> <file.ndjson>", nil)
+		}
+
+		transferService := services.NewCollectionTransferService(fsClient)
+		err = transferService.ExportCollection(ctx, args[0], args[1])
+		if err != nil {
+			logger.LogFatalLn("Failed to export collection", err)
+		}
+	case "import":
+		args := commandArgs()
+		if len(args) != 1 {
+			logger.LogFatalLn("Usage: import <file.ndjson>", nil)
+		}
+
+		transferService := services.NewCollectionTransferService(fsClient)
+		err = transferService.ImportDocuments(ctx, args[0])
+		if err != nil {
+			logger.LogFatalLn("Failed to import documents", err)
+		}
+	case "migrate":
+		args := commandArgs()
+		if len(args) == 0 {
+			logger.LogFatalLn("Usage: migrate <up|status|down> [--steps n]", nil)
+		}
+
+		runner := migrations.NewRunner(fsClient)
+		switch args[0] {
+		case "up":
+			err = runner.Up(ctx)
+		case "down":
+			flags := flag.NewFlagSet("migrate down", flag.ExitOnError)
+			steps := flags.Int("steps", 1, "number of applied migrations to revert")
+			flags.Parse(args[1:])
+			err = runner.Down(ctx, *steps)
+		case "status":
+			var statuses []migrations.MigrationStatus
+			statuses, err = runner.Status(ctx)
+			for _, status := range statuses {
+				logger.LogInfoWithFields(fmt.Sprintf("%04d %s", status.Version, status.Name), logrus.Fields{
+					"Applied":   status.Applied,
+					"AppliedAt": status.AppliedAt,
+				})
+			}
+		default:
+			logger.LogFatalLn(fmt.Sprintf("Unknown migrate subcommand: %s", args[0]), nil)
+		}
+		if err != nil {
+			logger.LogFatalLn("Migration command failed", err)
+		}
+	case "rollback":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		force := flags.Bool("force", false, "roll back a run that was already rolled back")
+		flags.Parse(commandArgs())
+		if flags.NArg() != 1 {
+			logger.LogFatalLn("Usage: rollback [--force] <runId>", nil)
+		}
+
+		backupService := services.NewBackupService(fsClient)
+		err = backupService.Rollback(ctx, flags.Arg(0), *force)
+		if err != nil {
+			logger.LogFatalLn("Failed to roll back run", err)
+		}
+	case "scan-references":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		nullDanglingRefs := flags.Bool("null-dangling-refs", false, "set location mapping refs to missing documents to null")
+		deleteOrphans := flags.Bool("delete-orphans", false, "delete analytics documents without a cost-of-living source")
+		flags.Parse(commandArgs())
+
+		scannerService := services.NewReferenceScannerService(fsClient)
+		_, err = scannerService.ScanReferences(ctx, services.ReferenceScanOptions{
+			NullDanglingRefs: *nullDanglingRefs,
+			DeleteOrphans:    *deleteOrphans,
+		})
+		if err != nil {
+			logger.LogFatalLn("Reference scan failed", err)
+		}
+	case "analyze-cost-of-living":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		force := flags.Bool("force", false, "score and write every city even if nothing changed")
+		analyzerOptions := analyzerFlags(flags)
+		flags.Parse(commandArgs())
+
+		analyzerService := services.NewCostOfLivingAnalyzerService(fsClient, analyzerOptions())
+		err = analyzerService.AnalyzeAndStoreData(ctx, *force)
+		if err != nil {
+			logger.LogFatalLn("Failed to analyze and store data", err)
+		}
+	case "compare-cities":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		salary := flags.Float64("salary", 3000, "monthly net salary in the first city, in USD")
+		budgetBasket := flags.String("budget-basket", services.DefaultBudgetBasketFile, "CSV of monthly budget basket items the equivalent salary is priced on")
+		metricCategories := flags.String("metric-categories", services.DefaultMetricCategoriesFile, "CSV mapping metrics to categories, empty for none")
+		flags.Parse(commandArgs())
+
+		args := flags.Args()
+		if len(args) != 2 {
+			logger.LogFatalLn("Usage: compare-cities [--salary n] \"<city>, <country>\" \"<city>, <country>\"", nil)
+		}
+		cityA, countryA, okA := splitCityCountry(args[0])
+		cityB, countryB, okB := splitCityCountry(args[1])
+		if !okA || !okB {
+			logger.LogFatalLn("Cities must be given as \"<city>, <country>\"", nil)
+		}
+
+		basket, err := services.LoadBudgetBasket(*budgetBasket)
+		if err != nil {
+			logger.LogFatalLn("Failed to load budget basket", err)
+		}
+
+		var categories []services.MetricCategory
+		if *metricCategories != "" {
+			categories, err = services.LoadMetricCategories(*metricCategories)
+			if err != nil {
+				logger.LogFatalLn("Failed to load metric categories", err)
+			}
+		}
+
+		comparisonService := services.NewCostOfLivingComparisonService(fsClient)
+		_, err = comparisonService.CompareCities(ctx, cityA, countryA, cityB, countryB, *salary, basket, categories)
+		if err != nil {
+			logger.LogFatalLn("Failed to compare cities", err)
+		}
+	case "cost-of-living-trends":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		top := flags.Int("top", 20, "cities listed in each direction")
+		destinationsOnly := flags.Bool("destinations-only", false, "only list cities in top-destinations")
+		flags.Parse(commandArgs())
+
+		trendsService := services.NewCostOfLivingTrendsService(fsClient)
+		_, err = trendsService.ReportTopMovers(ctx, *top, *destinationsOnly)
+		if err != nil {
+			logger.LogFatalLn("Failed to report top movers", err)
+		}
+	case "export-bigquery":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		dataset := flags.String("dataset", "wander_wallet", "BigQuery dataset the tables are written to")
+		mode := flags.String("mode", string(services.BigQueryAppend), "append or overwrite the run date's partition")
+		runDate := flags.String("run-date", time.Now().UTC().Format("2006-01-02"), "day partition to write, as YYYY-MM-DD")
+		endpoint := flags.String("endpoint", "", "BigQuery API endpoint, such as a local emulator, used without authentication")
+		flags.Parse(commandArgs())
+
+		writeMode, err := services.ParseBigQueryWriteMode(*mode)
+		if err != nil {
+			logger.LogFatalLn("Invalid export options", err)
+		}
+		date, err := time.Parse("2006-01-02", *runDate)
+		if err != nil {
+			logger.LogFatalLn("Invalid export options", err)
+		}
+
+		exportClient := bqClient
+		if *endpoint != "" {
+			exportClient, err = bigquery.NewClient(ctx, cfg.FirebaseProjectId, option.WithEndpoint(*endpoint), option.WithoutAuthentication())
+			if err != nil {
+				logger.LogFatalLn("Failed to create BigQuery client", err)
+			}
+			defer exportClient.Close()
+		}
+
+		exportService := services.NewBigQueryExportService(exportClient, fsClient)
+		err = exportService.ExportToBigQuery(ctx, services.BigQueryExportOptions{
+			Dataset: *dataset,
+			Mode:    writeMode,
+			RunDate: date,
+		})
+		if err != nil {
+			logger.LogFatalLn("Failed to export to BigQuery", err)
+		}
+	case "verify-migration":
+		migrationService := services.NewCostOfLivingMigrationService(fsClient)
+		_, err = migrationService.VerifyCostOfLivingMigration(ctx)
+		if err != nil {
+			logger.LogFatalLn("Cost-of-living migration verification failed", err)
+		}
+	case "enrich":
+		enrichService := services.NewTopDestinationEnrichmentService(bqClient, fsClient, cfg, mapsClient)
+		err = enrichService.EnrichTopDestinations(ctx)
+		if err != nil {
+			logger.LogFatalLn("Failed to enrich top destinations: %v", err)
+		}
+	default:
+		logger.LogFatalLn(fmt.Sprintf("Unknown command: %s", command), nil)
 	}
-	// errors := copyCitySafetyDocument(ctx, fsClient, "minneapolisstpaul-unitedstates", "minneapolis-unitedstates")
-	// if errors != nil {
-	// 	logger.LogErrorLn("Failed", errors)
-	// }
+}
 
+// commandArgs returns the arguments that follow the command name.
+func commandArgs() []string {
+	if len(os.Args) > 2 {
+		return os.Args[2:]
+	}
+	return nil
 }
 
-func copyCitySafetyDocument(ctx context.Context, client *firestore.Client, oldDocID, newDocID string) error {
-	// Step 1: Retrieve the original document
-	collectionName := "top-destinations"
-	docRef := client.Collection(collectionName).Doc(oldDocID)
-	docSnap, err := docRef.Get(ctx)
+// splitCityCountry splits "Lisbon, Portugal" into its city and country.
+func splitCityCountry(arg string) (string, string, bool) {
+	i := strings.LastIndex(arg, ",")
+	if i < 0 {
+		return "", "", false
+	}
+	city := strings.TrimSpace(arg[:i])
+	country := strings.TrimSpace(arg[i+1:])
+	return city, country, city != "" && country != ""
+}
+
+// configOptions builds analyzer options from a JSON file of analyzer flag
+// names and values, such as {"percentile-method": "linear", "impute": true}.
+// Flags it does not name keep their defaults.
+func configOptions(filename string) services.CostOfLivingAnalyzerOptions {
+	data, err := os.ReadFile(filename)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve original document: %v", err)
+		logger.LogFatalLn("Failed to read analyzer configuration", err)
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		logger.LogFatalLn(fmt.Sprintf("Invalid analyzer configuration %s", filename), err)
 	}
 
-	// Step 2: Check if the new document already exists
-	newDocRef := client.Collection(collectionName).Doc(newDocID)
-	_, err = newDocRef.Get(ctx)
-	if err == nil {
-		return fmt.Errorf("document with ID %s already exists", newDocID)
-	} else if err != nil {
-		fmt.Errorf("error checking new document: %v", err)
+	flags := flag.NewFlagSet(filename, flag.ExitOnError)
+	analyzerOptions := analyzerFlags(flags)
+	for name, raw := range values {
+		// Numbers and booleans are set as written, so 1000000 stays an integer
+		value := string(raw)
+		var text string
+		if json.Unmarshal(raw, &text) == nil {
+			value = text
+		}
+		if err := flags.Set(name, value); err != nil {
+			logger.LogFatalLn(fmt.Sprintf("Invalid analyzer configuration %s", filename), err)
+		}
 	}
+	return analyzerOptions()
+}
 
-	// Step 3: Create a copy of the document data
-	data := docSnap.Data()
+// analyzerFlags registers the cost-of-living analyzer options on flags. The
+// returned function builds the options once the flags have been parsed.
+func analyzerFlags(flags *flag.FlagSet) func() services.CostOfLivingAnalyzerOptions {
+	defaults := services.DefaultCostOfLivingAnalyzerOptions()
+	workers := flags.Int("workers", defaults.Workers, "metrics analyzed in parallel")
+	percentileMethod := flags.String("percentile-method", string(defaults.PercentileMethod), "lower-rank, mid-rank, linear or ecdf")
+	weightProfiles := flags.String("weight-profiles", services.DefaultWeightProfilesFile, "CSV of persona weight profiles, empty for none")
+	minPeerCount := flags.Int("min-peer-count", defaults.MinPeerCount, "cities a country or continent needs before it is ranked on its own")
+	baseCity := flags.String("index-base-city", defaults.IndexBaseCity, "city whose indices are 100")
+	baseCountry := flags.String("index-base-country", defaults.IndexBaseCountry, "country of the index base city")
+	impute := flags.Bool("impute", false, "score unreported metrics on country or continent medians or a regression")
+	datasetVersion := flags.String("dataset-version", defaults.DatasetVersion, "ID of the cost-of-living-stats document for this data, empty to keep the previous run's; changed data is only snapshotted under a new version")
+	budgetBasket := flags.String("budget-basket", services.DefaultBudgetBasketFile, "CSV of monthly budget basket items, empty for none")
+	metricCategories := flags.String("metric-categories", services.DefaultMetricCategoriesFile, "CSV mapping metrics to categories, empty for none")
+	similarCities := flags.Int("similar-cities", defaults.SimilarCities, "nearest neighbours stored per city, 0 for none")
+	similarity := flags.String("similarity", string(defaults.SimilarityMeasure), "cosine or euclidean")
+	maxClusters := flags.Int("max-clusters", defaults.MaxClusters, "largest number of cost clusters tried, such as 8; below 4 for none")
+	similarityProfile := flags.String("similarity-profile", "", "weight profile whose metric weights are used to compare cities, empty for equal weights")
 
-	// Step 4: Save the new document
-	_, err = newDocRef.Set(ctx, data)
-	if err != nil {
-		return fmt.Errorf("failed to create new document: %v", err)
-	}
+	return func() services.CostOfLivingAnalyzerOptions {
+		options := defaults
+		options.Workers = *workers
+		options.MinPeerCount = *minPeerCount
+		options.DatasetVersion = *datasetVersion
+		options.Impute = *impute
+		options.IndexBaseCity = *baseCity
+		options.IndexBaseCountry = *baseCountry
 
-	fmt.Printf("Successfully copied document from %s to %s\n", oldDocID, newDocID)
-	return nil
+		method, err := services.ParsePercentileMethod(*percentileMethod)
+		if err != nil {
+			logger.LogFatalLn("Invalid analyzer options", err)
+		}
+		options.PercentileMethod = method
+
+		options.SimilarCities = *similarCities
+		options.MaxClusters = *maxClusters
+		options.SimilarityMeasure, err = services.ParseSimilarityMeasure(*similarity)
+		if err != nil {
+			logger.LogFatalLn("Invalid analyzer options", err)
+		}
+
+		if *weightProfiles != "" {
+			options.WeightProfiles, err = services.LoadWeightProfiles(*weightProfiles)
+			if err != nil {
+				logger.LogFatalLn("Invalid analyzer options", err)
+			}
+		}
+		if *similarityProfile != "" {
+			options.SimilarityWeights, err = services.SimilarityWeights(options.WeightProfiles, *similarityProfile)
+			if err != nil {
+				logger.LogFatalLn("Invalid analyzer options", err)
+			}
+		}
+		if *budgetBasket != "" {
+			options.BudgetBasket, err = services.LoadBudgetBasket(*budgetBasket)
+			if err != nil {
+				logger.LogFatalLn("Invalid analyzer options", err)
+			}
+		}
+		if *metricCategories != "" {
+			options.Categories, err = services.LoadMetricCategories(*metricCategories)
+			if err != nil {
+				logger.LogFatalLn("Invalid analyzer options", err)
+			}
+		}
+		return options
+	}
 }
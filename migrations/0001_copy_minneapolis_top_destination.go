@@ -0,0 +1,62 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"wander-wallet-tools/retry"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Renames the Minneapolis-St. Paul top destination to match the
+// location-mappings ID used by the enrichment service.
+func init() {
+	Register(Migration{
+		Version: 1,
+		Name:    "copy-minneapolis-top-destination",
+		Up: func(ctx context.Context, client *firestore.Client) error {
+			return copyDocument(ctx, client, "top-destinations", "minneapolisstpaul-unitedstates", "minneapolis-unitedstates")
+		},
+		Down: func(ctx context.Context, client *firestore.Client) error {
+			return retry.Do(ctx, "delete minneapolis-unitedstates", func(ctx context.Context) error {
+				_, err := client.Collection("top-destinations").Doc("minneapolis-unitedstates").Delete(ctx)
+				return err
+			})
+		},
+	})
+}
+
+func copyDocument(ctx context.Context, client *firestore.Client, collectionName, oldDocID, newDocID string) error {
+	var docSnap *firestore.DocumentSnapshot
+	err := retry.Do(ctx, "get "+oldDocID, func(ctx context.Context) error {
+		var err error
+		docSnap, err = client.Collection(collectionName).Doc(oldDocID).Get(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to retrieve original document: %v", err)
+	}
+
+	newDocRef := client.Collection(collectionName).Doc(newDocID)
+	err = retry.Do(ctx, "get "+newDocID, func(ctx context.Context) error {
+		_, err := newDocRef.Get(ctx)
+		return err
+	})
+	if err == nil {
+		return fmt.Errorf("document with ID %s already exists", newDocID)
+	} else if status.Code(err) != codes.NotFound {
+		return fmt.Errorf("error checking new document: %v", err)
+	}
+
+	err = retry.Do(ctx, "set "+newDocID, func(ctx context.Context) error {
+		_, err := newDocRef.Set(ctx, docSnap.Data())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create new document: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/retry"
+
+	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
+)
+
+const migrationsCollection = "_migrations"
+
+// Migration is a numbered, ordered change to the Firestore schema or data.
+// Migrations register themselves from an init function in their own file.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, client *firestore.Client) error
+	Down    func(ctx context.Context, client *firestore.Client) error
+}
+
+// AppliedMigration is the ledger entry stored in _migrations once a
+// migration has been applied.
+type AppliedMigration struct {
+	Version   int       `firestore:"version"`
+	Name      string    `firestore:"name"`
+	AppliedAt time.Time `firestore:"appliedAt"`
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var registry = map[int]Migration{}
+
+func Register(migration Migration) {
+	if migration.Version <= 0 {
+		panic(fmt.Sprintf("migration %q must have a positive version", migration.Name))
+	}
+	if existing, ok := registry[migration.Version]; ok {
+		panic(fmt.Sprintf("migration version %d is registered twice: %q and %q", migration.Version, existing.Name, migration.Name))
+	}
+	if migration.Up == nil {
+		panic(fmt.Sprintf("migration %d %q has no Up function", migration.Version, migration.Name))
+	}
+	registry[migration.Version] = migration
+}
+
+func registered() []Migration {
+	migrations := make([]Migration, 0, len(registry))
+	for _, migration := range registry {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations
+}
+
+type Runner struct {
+	firestoreClient *firestore.Client
+}
+
+func NewRunner(firestoreClient *firestore.Client) *Runner {
+	return &Runner{
+		firestoreClient: firestoreClient,
+	}
+}
+
+// Up applies every registered migration that is not in the ledger yet, in
+// version order, and stops at the first failure.
+func (r *Runner) Up(ctx context.Context) error {
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, migration := range registered() {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		logger.LogInfoWithFields("Applying migration", logrus.Fields{"Version": migration.Version, "Name": migration.Name})
+		if err := migration.Up(ctx, r.firestoreClient); err != nil {
+			return fmt.Errorf("migration %d %s failed: %v", migration.Version, migration.Name, err)
+		}
+
+		entry := AppliedMigration{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: time.Now(),
+		}
+		err := retry.Do(ctx, "record migration", func(ctx context.Context) error {
+			_, err := r.ledgerDoc(migration.Version).Set(ctx, entry)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s was applied but could not be recorded: %v", migration.Version, migration.Name, err)
+		}
+		count++
+	}
+
+	logger.LogInfoLn(fmt.Sprintf("Applied %d migrations", count))
+	return nil
+}
+
+// Down reverts the most recently applied migrations, newest first. steps
+// must be at least 1.
+func (r *Runner) Down(ctx context.Context, steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("steps must be at least 1, got %d", steps)
+	}
+
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	versions := make([]int, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	if steps > len(versions) {
+		steps = len(versions)
+	}
+
+	for _, version := range versions[:steps] {
+		migration, ok := registry[version]
+		if !ok {
+			return fmt.Errorf("migration %d is applied but no longer registered", version)
+		}
+		if migration.Down == nil {
+			return fmt.Errorf("migration %d %s cannot be reverted", migration.Version, migration.Name)
+		}
+
+		logger.LogInfoWithFields("Reverting migration", logrus.Fields{"Version": migration.Version, "Name": migration.Name})
+		if err := migration.Down(ctx, r.firestoreClient); err != nil {
+			return fmt.Errorf("reverting migration %d %s failed: %v", migration.Version, migration.Name, err)
+		}
+		err := retry.Do(ctx, "remove migration record", func(ctx context.Context) error {
+			_, err := r.ledgerDoc(version).Delete(ctx)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s was reverted but could not be removed from the ledger: %v", migration.Version, migration.Name, err)
+		}
+	}
+
+	logger.LogInfoLn(fmt.Sprintf("Reverted %d migrations", steps))
+	return nil
+}
+
+// Status lists every registered migration and whether it has been applied.
+func (r *Runner) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range registered() {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if entry, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = entry.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (r *Runner) applied(ctx context.Context) (map[int]AppliedMigration, error) {
+	applied := make(map[int]AppliedMigration)
+	var docs []*firestore.DocumentSnapshot
+	err := retry.Do(ctx, "read migrations ledger", func(ctx context.Context) error {
+		var err error
+		docs, err = r.firestoreClient.Collection(migrationsCollection).Documents(ctx).GetAll()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations ledger: %v", err)
+	}
+
+	for _, doc := range docs {
+		var entry AppliedMigration
+		if err := doc.DataTo(&entry); err != nil {
+			return nil, fmt.Errorf("failed to parse migrations ledger entry %s: %v", doc.Ref.ID, err)
+		}
+		applied[entry.Version] = entry
+	}
+	return applied, nil
+}
+
+func (r *Runner) ledgerDoc(version int) *firestore.DocumentRef {
+	return r.firestoreClient.Collection(migrationsCollection).Doc(fmt.Sprintf("%04d", version))
+}
@@ -0,0 +1,227 @@
+package models
+
+// countryContinents maps the country names used in the cost-of-living data
+// to the continent names understood by getContinentCode.
+var countryContinents = map[string]string{
+	"Afghanistan":                      "Asia",
+	"Albania":                          "Europe",
+	"Algeria":                          "Africa",
+	"American Samoa":                   "Oceania",
+	"Andorra":                          "Europe",
+	"Angola":                           "Africa",
+	"Anguilla":                         "North America",
+	"Antigua And Barbuda":              "North America",
+	"Argentina":                        "South America",
+	"Armenia":                          "Asia",
+	"Aruba":                            "North America",
+	"Australia":                        "Oceania",
+	"Austria":                          "Europe",
+	"Azerbaijan":                       "Asia",
+	"Bahamas":                          "North America",
+	"Bahrain":                          "Asia",
+	"Bangladesh":                       "Asia",
+	"Barbados":                         "North America",
+	"Belarus":                          "Europe",
+	"Belgium":                          "Europe",
+	"Belize":                           "North America",
+	"Benin":                            "Africa",
+	"Bermuda":                          "North America",
+	"Bhutan":                           "Asia",
+	"Bolivia":                          "South America",
+	"Bosnia And Herzegovina":           "Europe",
+	"Botswana":                         "Africa",
+	"Brazil":                           "South America",
+	"British Virgin Islands":           "North America",
+	"Brunei":                           "Asia",
+	"Bulgaria":                         "Europe",
+	"Burkina Faso":                     "Africa",
+	"Burundi":                          "Africa",
+	"Cambodia":                         "Asia",
+	"Cameroon":                         "Africa",
+	"Canada":                           "North America",
+	"Cape Verde":                       "Africa",
+	"Chad":                             "Africa",
+	"Chile":                            "South America",
+	"China":                            "Asia",
+	"Colombia":                         "South America",
+	"Comoros":                          "Africa",
+	"Congo":                            "Africa",
+	"Cook Islands":                     "Oceania",
+	"Costa Rica":                       "North America",
+	"Croatia":                          "Europe",
+	"Cuba":                             "North America",
+	"Curacao":                          "North America",
+	"Cyprus":                           "Europe",
+	"Czech Republic":                   "Europe",
+	"Denmark":                          "Europe",
+	"Djibouti":                         "Africa",
+	"Dominica":                         "North America",
+	"Dominican Republic":               "North America",
+	"Ecuador":                          "South America",
+	"Egypt":                            "Africa",
+	"El Salvador":                      "North America",
+	"Equatorial Guinea":                "Africa",
+	"Eritrea":                          "Africa",
+	"Estonia":                          "Europe",
+	"Ethiopia":                         "Africa",
+	"Falkland Islands":                 "South America",
+	"Faroe Islands":                    "Europe",
+	"Fiji":                             "Oceania",
+	"Finland":                          "Europe",
+	"France":                           "Europe",
+	"French Guiana":                    "South America",
+	"French Polynesia":                 "Oceania",
+	"Gabon":                            "Africa",
+	"Gambia":                           "Africa",
+	"Georgia":                          "Asia",
+	"Germany":                          "Europe",
+	"Ghana":                            "Africa",
+	"Gibraltar":                        "Europe",
+	"Greece":                           "Europe",
+	"Greenland":                        "North America",
+	"Guadeloupe":                       "North America",
+	"Guatemala":                        "North America",
+	"Guinea":                           "Africa",
+	"Guinea-Bissau":                    "Africa",
+	"Guyana":                           "South America",
+	"Haiti":                            "North America",
+	"Honduras":                         "North America",
+	"Hong Kong":                        "Asia",
+	"Hungary":                          "Europe",
+	"Iceland":                          "Europe",
+	"India":                            "Asia",
+	"Indonesia":                        "Asia",
+	"Iran":                             "Asia",
+	"Iraq":                             "Asia",
+	"Ireland":                          "Europe",
+	"Isle Of Man":                      "Europe",
+	"Israel":                           "Asia",
+	"Italy":                            "Europe",
+	"Ivory Coast":                      "Africa",
+	"Jamaica":                          "North America",
+	"Japan":                            "Asia",
+	"Jersey":                           "Europe",
+	"Jordan":                           "Asia",
+	"Kazakhstan":                       "Asia",
+	"Kenya":                            "Africa",
+	"Kosovo (Disputed Territory)":      "Europe",
+	"Kuwait":                           "Asia",
+	"Kyrgyzstan":                       "Asia",
+	"Laos":                             "Asia",
+	"Latvia":                           "Europe",
+	"Lebanon":                          "Asia",
+	"Lesotho":                          "Africa",
+	"Liberia":                          "Africa",
+	"Libya":                            "Africa",
+	"Liechtenstein":                    "Europe",
+	"Lithuania":                        "Europe",
+	"Luxembourg":                       "Europe",
+	"Madagascar":                       "Africa",
+	"Malawi":                           "Africa",
+	"Malaysia":                         "Asia",
+	"Maldives":                         "Asia",
+	"Mali":                             "Africa",
+	"Malta":                            "Europe",
+	"Marshall Islands":                 "Oceania",
+	"Martinique":                       "North America",
+	"Mauritania":                       "Africa",
+	"Mauritius":                        "Africa",
+	"Mexico":                           "North America",
+	"Moldova":                          "Europe",
+	"Monaco":                           "Europe",
+	"Mongolia":                         "Asia",
+	"Montenegro":                       "Europe",
+	"Montserrat":                       "North America",
+	"Morocco":                          "Africa",
+	"Mozambique":                       "Africa",
+	"Myanmar":                          "Asia",
+	"Namibia":                          "Africa",
+	"Nauru":                            "Oceania",
+	"Nepal":                            "Asia",
+	"Netherlands":                      "Europe",
+	"New Caledonia":                    "Oceania",
+	"New Zealand":                      "Oceania",
+	"Nicaragua":                        "North America",
+	"Niger":                            "Africa",
+	"Nigeria":                          "Africa",
+	"North Korea":                      "Asia",
+	"North Macedonia":                  "Europe",
+	"Norway":                           "Europe",
+	"Oman":                             "Asia",
+	"Pakistan":                         "Asia",
+	"Panama":                           "North America",
+	"Papua New Guinea":                 "Oceania",
+	"Paraguay":                         "South America",
+	"Peru":                             "South America",
+	"Philippines":                      "Asia",
+	"Poland":                           "Europe",
+	"Portugal":                         "Europe",
+	"Puerto Rico":                      "North America",
+	"Qatar":                            "Asia",
+	"Reunion":                          "Africa",
+	"Romania":                          "Europe",
+	"Russia":                           "Europe",
+	"Rwanda":                           "Africa",
+	"Saint Helena":                     "Africa",
+	"Saint Kitts And Nevis":            "North America",
+	"Saint Lucia":                      "North America",
+	"Saint Vincent And The Grenadines": "North America",
+	"Samoa":                            "Oceania",
+	"San Marino":                       "Europe",
+	"Sao Tome And Principe":            "Africa",
+	"Saudi Arabia":                     "Asia",
+	"Senegal":                          "Africa",
+	"Serbia":                           "Europe",
+	"Seychelles":                       "Africa",
+	"Sierra Leone":                     "Africa",
+	"Singapore":                        "Asia",
+	"Sint Maarten":                     "North America",
+	"Slovakia":                         "Europe",
+	"Slovenia":                         "Europe",
+	"Solomon Islands":                  "Oceania",
+	"Somalia":                          "Africa",
+	"South Africa":                     "Africa",
+	"South Korea":                      "Asia",
+	"South Sudan":                      "Africa",
+	"Spain":                            "Europe",
+	"Sri Lanka":                        "Asia",
+	"Sudan":                            "Africa",
+	"Suriname":                         "South America",
+	"Swaziland":                        "Africa",
+	"Sweden":                           "Europe",
+	"Switzerland":                      "Europe",
+	"Syria":                            "Asia",
+	"Taiwan":                           "Asia",
+	"Tajikistan":                       "Asia",
+	"Tanzania":                         "Africa",
+	"Thailand":                         "Asia",
+	"Timor-Leste":                      "Asia",
+	"Togo":                             "Africa",
+	"Tonga":                            "Oceania",
+	"Trinidad And Tobago":              "North America",
+	"Tunisia":                          "Africa",
+	"Turkey":                           "Europe",
+	"Turkmenistan":                     "Asia",
+	"Turks And Caicos Islands":         "North America",
+	"Tuvalu":                           "Oceania",
+	"Uganda":                           "Africa",
+	"Ukraine":                          "Europe",
+	"United Arab Emirates":             "Asia",
+	"United Kingdom":                   "Europe",
+	"United States":                    "North America",
+	"Uruguay":                          "South America",
+	"Uzbekistan":                       "Asia",
+	"Vanuatu":                          "Oceania",
+	"Vatican City":                     "Europe",
+	"Venezuela":                        "South America",
+	"Vietnam":                          "Asia",
+	"Yemen":                            "Asia",
+	"Zambia":                           "Africa",
+	"Zimbabwe":                         "Africa",
+}
+
+// GetCountryContinentCode returns the two-letter continent code of a country,
+// or "" when the country is unknown.
+func GetCountryContinentCode(country string) string {
+	return getContinentCode(countryContinents[country])
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"reflect"
 	"wander-wallet-tools/utils"
 )
 
@@ -73,3 +74,34 @@ func GetCostOfLivingPath(city, country string) string {
 	id := fmt.Sprintf("%s-%s", formattedCity, formattedCountry)
 	return fmt.Sprintf("%s/%s", collectionName, id)
 }
+
+var costOfLivingFields = firestoreFieldIndex(reflect.TypeOf(CostOfLiving{}))
+
+// CostOfLivingMetrics lists the firestore keys of every price, income and
+// rate field of CostOfLiving in declaration order.
+var CostOfLivingMetrics = costOfLivingMetrics()
+
+func costOfLivingMetrics() []string {
+	t := reflect.TypeOf(CostOfLiving{})
+	var metrics []string
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() == reflect.Float64 {
+			metrics = append(metrics, t.Field(i).Tag.Get("firestore"))
+		}
+	}
+	return metrics
+}
+
+// MetricValue returns the value of a metric by its firestore key, or 0 if
+// the metric is unknown.
+func (c CostOfLiving) MetricValue(metric string) float64 {
+	i, ok := costOfLivingFields[metric]
+	if !ok {
+		return 0
+	}
+	field := reflect.ValueOf(c).Field(i)
+	if field.Kind() != reflect.Float64 {
+		return 0
+	}
+	return field.Float()
+}
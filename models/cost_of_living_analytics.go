@@ -2,21 +2,132 @@ package models
 
 import (
 	"fmt"
+	"math"
+	"reflect"
 	"wander-wallet-tools/utils"
+
+	"cloud.google.com/go/firestore"
 )
 
-type MetricStats struct {
-	Min   float64 `firestore:"min"`
-	Max   float64 `firestore:"max"`
-	Avg   float64 `firestore:"avg"`
-	Count int64   `firestore:"count"`
+type CostOfLivingAnalytics struct {
+	City           string `firestore:"city"`
+	Country        string `firestore:"country"`
+	DatasetVersion string `firestore:"datasetVersion"`
+	// SourceHash fingerprints the cost-of-living document the analytics were
+	// computed from, so unchanged cities can be skipped
+	SourceHash  string `firestore:"sourceHash"`
+	DataQuality int    `firestore:"dataQuality"`
+	// ContinentCode is the two-letter code of the continent the city is
+	// ranked against in ContinentScores
+	ContinentCode string `firestore:"continentCode,omitempty"`
+	// PercentileMethod is the method the scores were ranked with, such as
+	// "mid-rank" or "linear"
+	PercentileMethod string `firestore:"percentileMethod"`
+	Scores           Scores `firestore:"scores"`
+	// Imputed lists the scored metrics the city does not report, keyed like
+	// Scores, with the estimate they were scored on
+	Imputed map[string]ImputedValue `firestore:"imputed,omitempty"`
+	// CountryScores and ContinentScores rank each metric within the city's
+	// country and continent, keyed like Scores. Metrics with too few peers in
+	// the scope are left out.
+	CountryScores   map[string]float64 `firestore:"countryScores,omitempty"`
+	ContinentScores map[string]float64 `firestore:"continentScores,omitempty"`
+	// OverallByProfile holds the weighted overall score of each persona
+	// weight profile, keyed by profile name
+	OverallByProfile map[string]float64 `firestore:"overallByProfile,omitempty"`
+	// Categories holds a sub-score per spending category, keyed by category
+	// name
+	Categories map[string]CategoryScore `firestore:"categories,omitempty"`
+	Indices    *CostOfLivingIndices     `firestore:"indices,omitempty"`
+	Budget     *CostOfLivingBudget      `firestore:"budget,omitempty"`
+	// SimilarCities are the cities with the closest cost profile, most
+	// similar first
+	SimilarCities []SimilarCity `firestore:"similarCities,omitempty"`
+	// PriceTier is "$" to "$$$$" by the price level of the city's cluster
+	PriceTier string       `firestore:"priceTier,omitempty"`
+	Cluster   *CostCluster `firestore:"cluster,omitempty"`
+	// Trend compares the city's prices with an earlier dataset version
+	Trend *CostOfLivingTrend `firestore:"trend,omitempty"`
+	// StatsRef points at the cost-of-living-stats document holding the
+	// distribution of every metric for the dataset version
+	StatsRef *firestore.DocumentRef `firestore:"statsRef,omitempty"`
 }
 
-type CostOfLivingAnalytics struct {
-	City    string `firestore:"city"`
-	Country string `firestore:"country"`
-	Scores  Scores `firestore:"scores"`
-	Stats   Stats  `firestore:"stats"`
+// SimilarCity is a neighbour of a city by its metric percentiles. Overall is
+// the neighbour's overall score, so cheaper alternatives can be picked out
+// without reading its analytics.
+type SimilarCity struct {
+	City       string  `firestore:"city"`
+	Country    string  `firestore:"country"`
+	Similarity float64 `firestore:"similarity"`
+	Overall    float64 `firestore:"overall"`
+}
+
+// CostCluster is the group of cities with similar prices a city belongs to.
+// Clusters are numbered from 0, the cheapest, to Clusters-1. Level is the
+// mean percentile of the cluster centre and Profile describes what is cheap
+// and expensive there compared to that level.
+type CostCluster struct {
+	Id       int     `firestore:"id"`
+	Clusters int     `firestore:"clusters"`
+	Level    float64 `firestore:"level"`
+	Profile  string  `firestore:"profile"`
+}
+
+// CostOfLivingTrend holds annualized percentage price changes since
+// BaselineVersion, Years earlier. MetricChanges is keyed by metric and only
+// has the metrics reported in both versions. Inflation is the change in the
+// cost of a fixed basket, priced on the BasketItems reported in both.
+type CostOfLivingTrend struct {
+	BaselineVersion string             `firestore:"baselineVersion"`
+	Years           float64            `firestore:"years"`
+	MetricChanges   map[string]float64 `firestore:"metricChanges"`
+	Inflation       float64            `firestore:"inflation"`
+	BasketItems     int                `firestore:"basketItems"`
+}
+
+// ImputedValue is an estimate for a metric a city does not report. Method is
+// "country-median", "continent-median" or "regression", in which case
+// Predictor names the metric it was estimated from.
+type ImputedValue struct {
+	Value     float64 `firestore:"value"`
+	Method    string  `firestore:"method"`
+	Predictor string  `firestore:"predictor,omitempty"`
+}
+
+// CostOfLivingIndices relate a city's prices to its salaries and to a base
+// city. The indices are 100 for the base city; the ratios are absolute.
+// Values that cannot be computed from the reported metrics are 0 and left out.
+type CostOfLivingIndices struct {
+	BaseCity                   string  `firestore:"baseCity"`
+	BaseCountry                string  `firestore:"baseCountry"`
+	CostOfLiving               float64 `firestore:"costOfLiving,omitempty"`
+	Rent                       float64 `firestore:"rent,omitempty"`
+	CostOfLivingPlusRent       float64 `firestore:"costOfLivingPlusRent,omitempty"`
+	PurchasingPower            float64 `firestore:"purchasingPower,omitempty"`
+	RentToIncomeIndex          float64 `firestore:"rentToIncomeIndex,omitempty"`
+	PriceToIncomeIndex         float64 `firestore:"priceToIncomeIndex,omitempty"`
+	MortgageShareOfIncomeIndex float64 `firestore:"mortgageShareOfIncomeIndex,omitempty"`
+
+	// RentToIncome is a city centre one-bedroom rent as a percentage of the
+	// average net salary
+	RentToIncome float64 `firestore:"rentToIncome,omitempty"`
+	// PriceToIncome is the years of average net salary needed to buy a
+	// 90 m² city centre apartment
+	PriceToIncome float64 `firestore:"priceToIncome,omitempty"`
+	// MortgageShareOfIncome is the monthly payment on that apartment with a
+	// 20 year mortgage as a percentage of the average net salary
+	MortgageShareOfIncome float64 `firestore:"mortgageShareOfIncome,omitempty"`
+}
+
+// CategoryScore is the mean percentile of the metrics in a category that the
+// city is scored on. ContributingMetrics out of TotalMetrics, the metrics the
+// city reports, shows its coverage; ImputedMetrics are scored on estimates.
+type CategoryScore struct {
+	Score               float64 `firestore:"score"`
+	ContributingMetrics int     `firestore:"contributingMetrics"`
+	ImputedMetrics      int     `firestore:"imputedMetrics,omitempty"`
+	TotalMetrics        int     `firestore:"totalMetrics"`
 }
 
 type Scores struct {
@@ -47,99 +158,90 @@ type Scores struct {
 	TicketOneWay              float64 `firestore:"ticketOneWay"`
 	Utilities85sqmApartment   float64 `firestore:"utilities85sqmApartment"`
 	WaterRestaurant           float64 `firestore:"waterRestaurant"`
+	Milk1L                    float64 `firestore:"milk1L"`
+	BreadLoaf                 float64 `firestore:"breadLoaf"`
+	Rice1Kg                   float64 `firestore:"rice1Kg"`
+	Eggs12Pack                float64 `firestore:"eggs12Pack"`
+	LocalCheese1Kg            float64 `firestore:"localCheese1Kg"`
+	ChickenFillet1Kg          float64 `firestore:"chickenFillet1Kg"`
+	BeefRound1Kg              float64 `firestore:"beefRound1Kg"`
+	Apples1Kg                 float64 `firestore:"apples1Kg"`
+	Banana1Kg                 float64 `firestore:"banana1Kg"`
+	Oranges1Kg                float64 `firestore:"oranges1Kg"`
+	Tomato1Kg                 float64 `firestore:"tomato1Kg"`
+	Potato1Kg                 float64 `firestore:"potato1Kg"`
+	Onion1Kg                  float64 `firestore:"onion1Kg"`
+	LettuceHead               float64 `firestore:"lettuceHead"`
+	Water1_5LMarket           float64 `firestore:"water1_5LMarket"`
+	WineMidRange              float64 `firestore:"wineMidRange"`
+	CigarettesPack            float64 `firestore:"cigarettesPack"`
+	TaxiWaiting1Hour          float64 `firestore:"taxiWaiting1Hour"`
+	VWGolfNew                 float64 `firestore:"vwGolfNew"`
+	ToyotaCorollaNew          float64 `firestore:"toyotaCorollaNew"`
+	TennisCourtHourly         float64 `firestore:"tennisCourtHourly"`
+	CinemaTicket              float64 `firestore:"cinemaTicket"`
+	PreschoolMonthly          float64 `firestore:"preschoolMonthly"`
+	IntlPrimarySchoolYearly   float64 `firestore:"intlPrimarySchoolYearly"`
+	Jeans                     float64 `firestore:"jeans"`
+	SummerDress               float64 `firestore:"summerDress"`
+	NikeShoes                 float64 `firestore:"nikeShoes"`
+	LeatherShoes              float64 `firestore:"leatherShoes"`
+	MortgageRate              float64 `firestore:"mortgageRate"`
+}
+
+var scoresFields = firestoreFieldIndex(reflect.TypeOf(Scores{}))
+
+// Get returns the score of a metric by its firestore key.
+func (s Scores) Get(metric string) float64 {
+	if i, ok := scoresFields[metric]; ok {
+		return reflect.ValueOf(s).Field(i).Float()
+	}
+	return 0
+}
+
+// MaxDifference returns the largest absolute difference between any score,
+// including overall, of s and other.
+func (s Scores) MaxDifference(other Scores) float64 {
+	a, b := reflect.ValueOf(s), reflect.ValueOf(other)
+	max := 0.0
+	for i := 0; i < a.NumField(); i++ {
+		if diff := math.Abs(a.Field(i).Float() - b.Field(i).Float()); diff > max {
+			max = diff
+		}
+	}
+	return max
+}
+
+// Set stores the score of a metric by its firestore key. Unknown metrics
+// are ignored.
+func (s *Scores) Set(metric string, score float64) {
+	if i, ok := scoresFields[metric]; ok {
+		reflect.ValueOf(s).Elem().Field(i).SetFloat(score)
+	}
+}
+
+// CostOfLivingBudget is the monthly cost of the budget basket in USD at each
+// budget level.
+type CostOfLivingBudget struct {
+	Lean        BudgetTier `firestore:"lean"`
+	Moderate    BudgetTier `firestore:"moderate"`
+	Comfortable BudgetTier `firestore:"comfortable"`
+}
 
-	// Unused fields
-	Milk1L                  float64 `firestore:"milk1L"`
-	BreadLoaf               float64 `firestore:"breadLoaf"`
-	Rice1Kg                 float64 `firestore:"rice1Kg"`
-	Eggs12Pack              float64 `firestore:"eggs12Pack"`
-	LocalCheese1Kg          float64 `firestore:"localCheese1Kg"`
-	ChickenFillet1Kg        float64 `firestore:"chickenFillet1Kg"`
-	BeefRound1Kg            float64 `firestore:"beefRound1Kg"`
-	Apples1Kg               float64 `firestore:"apples1Kg"`
-	Banana1Kg               float64 `firestore:"banana1Kg"`
-	Oranges1Kg              float64 `firestore:"oranges1Kg"`
-	Tomato1Kg               float64 `firestore:"tomato1Kg"`
-	Potato1Kg               float64 `firestore:"potato1Kg"`
-	Onion1Kg                float64 `firestore:"onion1Kg"`
-	LettuceHead             float64 `firestore:"lettuceHead"`
-	Water1_5LMarket         float64 `firestore:"water1_5LMarket"`
-	WineMidRange            float64 `firestore:"wineMidRange"`
-	CigarettesPack          float64 `firestore:"cigarettesPack"`
-	TaxiWaiting1Hour        float64 `firestore:"taxiWaiting1Hour"`
-	VWGolfNew               float64 `firestore:"vwGolfNew"`
-	ToyotaCorollaNew        float64 `firestore:"toyotaCorollaNew"`
-	TennisCourtHourly       float64 `firestore:"tennisCourtHourly"`
-	CinemaTicket            float64 `firestore:"cinemaTicket"`
-	PreschoolMonthly        float64 `firestore:"preschoolMonthly"`
-	IntlPrimarySchoolYearly float64 `firestore:"intlPrimarySchoolYearly"`
-	Jeans                   float64 `firestore:"jeans"`
-	SummerDress             float64 `firestore:"summerDress"`
-	NikeShoes               float64 `firestore:"nikeShoes"`
-	LeatherShoes            float64 `firestore:"leatherShoes"`
-	MortgageRate            float64 `firestore:"mortgageRate"`
-	DataQuality             float64 `firestore:"dataQuality"`
+// BudgetTier totals the basket lines at one budget level. MissingItems lists
+// basket items the city has no price for, which are not in the total.
+type BudgetTier struct {
+	Total        float64      `firestore:"total"`
+	Lines        []BudgetLine `firestore:"lines"`
+	MissingItems []string     `firestore:"missingItems,omitempty"`
 }
 
-type Stats struct {
-	Apt1BedCityCenter         MetricStats `firestore:"apt1BedCityCenter"`
-	Apt1BedOutsideCenter      MetricStats `firestore:"apt1BedOutsideCenter"`
-	Apt3BedCityCenter         MetricStats `firestore:"apt3BedCityCenter"`
-	Apt3BedOutsideCenter      MetricStats `firestore:"apt3BedOutsideCenter"`
-	AvgNetSalary              MetricStats `firestore:"avgNetSalary"`
-	CappuccinoRestaurant      MetricStats `firestore:"cappuccinoRestaurant"`
-	ComboMealMcdonalds        MetricStats `firestore:"comboMealMcdonalds"`
-	DomesticBeerMarket        MetricStats `firestore:"domesticBeerMarket"`
-	DomesticBeerRestaurant    MetricStats `firestore:"domesticBeerRestaurant"`
-	FitnessClubMonthly        MetricStats `firestore:"fitnessClubMonthly"`
-	Gasoline1L                MetricStats `firestore:"gasoline1L"`
-	ImportedBeerMarket        MetricStats `firestore:"importedBeerMarket"`
-	ImportedBeerRestaurant    MetricStats `firestore:"importedBeerRestaurant"`
-	InternetUnlimited         MetricStats `firestore:"internetUnlimited"`
-	MealInexpensiveRestaurant MetricStats `firestore:"mealInexpensiveRestaurant"`
-	MealFor2MidRange          MetricStats `firestore:"mealFor2MidRange"`
-	MobileTariff1Min          MetricStats `firestore:"mobileTariff1Min"`
-	MonthlyPass               MetricStats `firestore:"monthlyPass"`
-	PricePerSqmCityCenter     MetricStats `firestore:"pricePerSqmCityCenter"`
-	PricePerSqmOutsideCenter  MetricStats `firestore:"pricePerSqmOutsideCenter"`
-	SodaRestaurant            MetricStats `firestore:"sodaRestaurant"`
-	TaxiStart                 MetricStats `firestore:"taxiStart"`
-	Taxi1Km                   MetricStats `firestore:"taxi1Km"`
-	TicketOneWay              MetricStats `firestore:"ticketOneWay"`
-	Utilities85sqmApartment   MetricStats `firestore:"utilities85sqmApartment"`
-	WaterRestaurant           MetricStats `firestore:"waterRestaurant"`
-
-	// Unused fields
-	Milk1L                  MetricStats `firestore:"milk1L"`
-	BreadLoaf               MetricStats `firestore:"breadLoaf"`
-	Rice1Kg                 MetricStats `firestore:"rice1Kg"`
-	Eggs12Pack              MetricStats `firestore:"eggs12Pack"`
-	LocalCheese1Kg          MetricStats `firestore:"localCheese1Kg"`
-	ChickenFillet1Kg        MetricStats `firestore:"chickenFillet1Kg"`
-	BeefRound1Kg            MetricStats `firestore:"beefRound1Kg"`
-	Apples1Kg               MetricStats `firestore:"apples1Kg"`
-	Banana1Kg               MetricStats `firestore:"banana1Kg"`
-	Oranges1Kg              MetricStats `firestore:"oranges1Kg"`
-	Tomato1Kg               MetricStats `firestore:"tomato1Kg"`
-	Potato1Kg               MetricStats `firestore:"potato1Kg"`
-	Onion1Kg                MetricStats `firestore:"onion1Kg"`
-	LettuceHead             MetricStats `firestore:"lettuceHead"`
-	Water1_5LMarket         MetricStats `firestore:"water1_5LMarket"`
-	WineMidRange            MetricStats `firestore:"wineMidRange"`
-	CigarettesPack          MetricStats `firestore:"cigarettesPack"`
-	TaxiWaiting1Hour        MetricStats `firestore:"taxiWaiting1Hour"`
-	VWGolfNew               MetricStats `firestore:"vwGolfNew"`
-	ToyotaCorollaNew        MetricStats `firestore:"toyotaCorollaNew"`
-	TennisCourtHourly       MetricStats `firestore:"tennisCourtHourly"`
-	CinemaTicket            MetricStats `firestore:"cinemaTicket"`
-	PreschoolMonthly        MetricStats `firestore:"preschoolMonthly"`
-	IntlPrimarySchoolYearly MetricStats `firestore:"intlPrimarySchoolYearly"`
-	Jeans                   MetricStats `firestore:"jeans"`
-	SummerDress             MetricStats `firestore:"summerDress"`
-	NikeShoes               MetricStats `firestore:"nikeShoes"`
-	LeatherShoes            MetricStats `firestore:"leatherShoes"`
-	MortgageRate            MetricStats `firestore:"mortgageRate"`
-	DataQuality             MetricStats `firestore:"dataQuality"`
+type BudgetLine struct {
+	Item      string  `firestore:"item"`
+	Metric    string  `firestore:"metric"`
+	Quantity  float64 `firestore:"quantity"`
+	UnitPrice float64 `firestore:"unitPrice"`
+	Cost      float64 `firestore:"cost"`
 }
 
 func GetCostOfLivingAnalyticsPath(city, country string) string {
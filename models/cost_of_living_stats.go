@@ -0,0 +1,47 @@
+package models
+
+import (
+	"fmt"
+	"time"
+	"wander-wallet-tools/utils"
+)
+
+// MetricStats describes the distribution of one metric across the cities
+// that report it. Percentiles are linearly interpolated between values; MAD
+// is the median absolute deviation from the median.
+type MetricStats struct {
+	Count  int64   `firestore:"count"`
+	Min    float64 `firestore:"min"`
+	Max    float64 `firestore:"max"`
+	Mean   float64 `firestore:"mean"`
+	Median float64 `firestore:"median"`
+	P10    float64 `firestore:"p10"`
+	P25    float64 `firestore:"p25"`
+	P75    float64 `firestore:"p75"`
+	P90    float64 `firestore:"p90"`
+	IQR    float64 `firestore:"iqr"`
+	StdDev float64 `firestore:"stdDev"`
+	MAD    float64 `firestore:"mad"`
+}
+
+// CostOfLivingStats holds the distribution stats of every metric for one
+// version of the cost-of-living dataset, keyed by metric.
+type CostOfLivingStats struct {
+	DatasetVersion string                 `firestore:"datasetVersion"`
+	Cities         int                    `firestore:"cities"`
+	ComputedAt     time.Time              `firestore:"computedAt"`
+	Metrics        map[string]MetricStats `firestore:"metrics"`
+}
+
+func GetCostOfLivingStatsPath(datasetVersion string) string {
+	return fmt.Sprintf("%s/%s", "cost-of-living-stats", datasetVersion)
+}
+
+// GetCostOfLivingSnapshotPath is the path of a city's cost-of-living data as
+// it was in a dataset version, kept under the version's stats document.
+func GetCostOfLivingSnapshotPath(datasetVersion, city, country string) string {
+	formattedCity := utils.NormalizeAndFormat(city)
+	formattedCountry := utils.NormalizeAndFormat(country)
+	id := fmt.Sprintf("%s-%s", formattedCity, formattedCountry)
+	return fmt.Sprintf("%s/cities/%s", GetCostOfLivingStatsPath(datasetVersion), id)
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+)
+
+// firestoreFieldIndex maps the firestore tag name of each field of t to the
+// field's index, so typed documents can be read and written by key.
+func firestoreFieldIndex(t reflect.Type) map[string]int {
+	index := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("firestore"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		index[name] = i
+	}
+	return index
+}
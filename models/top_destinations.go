@@ -12,4 +12,5 @@ type TopDestination struct {
 	DownloadAvg       float64  `firestore:"downloadAvg"`
 	SafetyScore       int64    `firestore:"safetyScore"`
 	CostOfLivingScore float64  `firestore:"costOfLivingScore"`
+	PriceTier         string   `firestore:"priceTier"`
 }
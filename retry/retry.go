@@ -0,0 +1,193 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"wander-wallet-tools/logger"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Policy describes how often and how long to wait between attempts. The
+// delay before attempt n is drawn uniformly from [0, InitialBackoff *
+// Multiplier^n], capped at MaxBackoff ("full jitter").
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+var DefaultPolicy = Policy{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+}
+
+// HTTPError is returned by plain HTTP integrations (such as Pexels) so the
+// status code and Retry-After header can be classified.
+type HTTPError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// NewHTTPError builds an HTTPError from a non-2xx response.
+func NewHTTPError(resp *http.Response) *HTTPError {
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// Do calls fn with DefaultPolicy.
+func Do(ctx context.Context, operation string, fn func(ctx context.Context) error) error {
+	return DefaultPolicy.Do(ctx, operation, fn)
+}
+
+// Do calls fn until it succeeds, returns a permanent error, runs out of
+// attempts, or the next wait would pass the context deadline.
+func (p Policy) Do(ctx context.Context, operation string, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; attempt < p.MaxAttempts; attempt++ {
+		err = fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || !IsRetryable(err) || attempt == p.MaxAttempts-1 {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		if retryAfter := RetryAfter(err); retryAfter > delay {
+			delay = retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		logger.LogErrorWithFields("Retrying failed operation", logrus.Fields{
+			"Error":     err.Error(),
+			"Operation": operation,
+			"Attempt":   fmt.Sprintf("%d/%d", attempt+1, p.MaxAttempts),
+			"Delay":     delay.String(),
+		})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+func (p Policy) backoff(attempt int) time.Duration {
+	ceiling := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt))
+	if ceiling > float64(p.MaxBackoff) {
+		ceiling = float64(p.MaxBackoff)
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// IsRetryable reports whether err is transient: gRPC Unavailable,
+// ResourceExhausted or Aborted, HTTP 429 or 5xx, Maps over-quota errors, and
+// network timeouts. Everything else is treated as permanent.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return isRetryableStatusCode(httpErr.StatusCode)
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return isRetryableStatusCode(apiErr.Code)
+	}
+
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+			return true
+		}
+	}
+
+	// The Maps client reports API statuses as plain errors
+	message := err.Error()
+	if strings.HasPrefix(message, "maps: OVER_QUERY_LIMIT") || strings.HasPrefix(message, "maps: UNKNOWN_ERROR") {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+func isRetryableStatusCode(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// RetryAfter returns the server-requested delay carried by err, if any.
+func RetryAfter(err error) time.Duration {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.RetryAfter
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Header != nil {
+		return parseRetryAfter(apiErr.Header.Get("Retry-After"))
+	}
+
+	if s, ok := status.FromError(err); ok {
+		for _, detail := range s.Details() {
+			if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+				return info.GetRetryDelay().AsDuration()
+			}
+		}
+	}
+
+	return 0
+}
+
+// parseRetryAfter accepts both forms of the header: delay-seconds and an
+// HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/retry"
+
+	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	backupsCollection         = "_backups"
+	backupDocumentsCollection = "documents"
+	maxBackupBatchSize        = 500 // Firestore limit
+)
+
+type BackupService struct {
+	firestoreClient *firestore.Client
+}
+
+// BackupRun captures the previous version of every document an operation
+// overwrites or deletes, under _backups/{runId}/documents.
+type BackupRun struct {
+	RunId        string    `firestore:"runId"`
+	Operation    string    `firestore:"operation"`
+	StartedAt    time.Time `firestore:"startedAt"`
+	RolledBackAt time.Time `firestore:"rolledBackAt,omitempty"`
+
+	firestoreClient *firestore.Client
+	mu              sync.Mutex
+	captured        map[string]bool
+}
+
+// DocumentBackup is the state of a document before the run first wrote it.
+// Existed is false for documents the run created.
+type DocumentBackup struct {
+	Path       string                 `firestore:"path"`
+	Existed    bool                   `firestore:"existed"`
+	Data       map[string]interface{} `firestore:"data"`
+	CapturedAt time.Time              `firestore:"capturedAt"`
+}
+
+func NewBackupService(firestoreClient *firestore.Client) *BackupService {
+	return &BackupService{
+		firestoreClient: firestoreClient,
+	}
+}
+
+func (s *BackupService) StartRun(ctx context.Context, operation string) (*BackupRun, error) {
+	startedAt := time.Now().UTC()
+	run := &BackupRun{
+		RunId:           fmt.Sprintf("%s-%s", operation, startedAt.Format("20060102T150405.000Z")),
+		Operation:       operation,
+		StartedAt:       startedAt,
+		firestoreClient: s.firestoreClient,
+		captured:        make(map[string]bool),
+	}
+	run.RunId = strings.ReplaceAll(run.RunId, ".", "")
+
+	_, err := setDocument(ctx, s.firestoreClient.Collection(backupsCollection).Doc(run.RunId), run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup run: %v", err)
+	}
+
+	logger.LogInfoWithFields("Started backup run", logrus.Fields{"RunId": run.RunId, "Operation": operation})
+	return run, nil
+}
+
+// Capture stores the current version of each document before it is
+// overwritten. Documents already captured by this run are skipped so the
+// backup always holds the state from before the run started.
+func (r *BackupRun) Capture(ctx context.Context, refs ...*firestore.DocumentRef) error {
+	r.mu.Lock()
+	var pending []*firestore.DocumentRef
+	for _, ref := range refs {
+		if ref == nil || r.captured[ref.Path] {
+			continue
+		}
+		r.captured[ref.Path] = true
+		pending = append(pending, ref)
+	}
+	r.mu.Unlock()
+
+	for i := 0; i < len(pending); i += maxBackupBatchSize {
+		end := i + maxBackupBatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+
+		if err := r.captureBatch(ctx, pending[i:end]); err != nil {
+			r.mu.Lock()
+			for _, ref := range pending[i:] {
+				delete(r.captured, ref.Path)
+			}
+			r.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *BackupRun) captureBatch(ctx context.Context, refs []*firestore.DocumentRef) error {
+	docSnaps, err := getAllDocuments(ctx, r.firestoreClient, refs)
+	if err != nil {
+		return fmt.Errorf("failed to read documents for backup: %v", err)
+	}
+
+	capturedAt := time.Now()
+	batch := r.firestoreClient.Batch()
+	for i, doc := range docSnaps {
+		backup := DocumentBackup{
+			Path:       relativeDocumentPath(refs[i]),
+			Existed:    doc.Exists(),
+			CapturedAt: capturedAt,
+		}
+		if doc.Exists() {
+			backup.Data = doc.Data()
+		}
+		batch.Set(r.documentsCollection().Doc(backupDocumentID(backup.Path)), backup)
+	}
+
+	if err := commitBatch(ctx, batch); err != nil {
+		return fmt.Errorf("failed to write document backups: %v", err)
+	}
+	return nil
+}
+
+func (r *BackupRun) documentsCollection() *firestore.CollectionRef {
+	return r.firestoreClient.Collection(backupsCollection).Doc(r.RunId).Collection(backupDocumentsCollection)
+}
+
+// Rollback restores every document captured by the run to its previous
+// version and deletes the documents the run created. A run that was already
+// rolled back is refused unless force is set, since rolling it back again
+// would also revert every write made since.
+func (s *BackupService) Rollback(ctx context.Context, runId string, force bool) error {
+	logger.LogInfoLn(fmt.Sprintf("Starting rollback of backup run %s", runId))
+
+	runRef := s.firestoreClient.Collection(backupsCollection).Doc(runId)
+	runDoc, err := getDocument(ctx, runRef)
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("backup run %s does not exist", runId)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get backup run: %v", err)
+	}
+
+	var run BackupRun
+	if err := runDoc.DataTo(&run); err != nil {
+		return fmt.Errorf("failed to parse backup run: %v", err)
+	}
+	if !run.RolledBackAt.IsZero() {
+		if !force {
+			return fmt.Errorf("backup run %s was already rolled back at %s, use --force to roll it back again", runId, run.RolledBackAt.Format(time.RFC3339))
+		}
+		logger.LogInfoWithFields("Rolling back a run that was already rolled back", logrus.Fields{
+			"RunId":        runId,
+			"RolledBackAt": run.RolledBackAt,
+		})
+	}
+
+	docs, err := queryAllDocuments(ctx, runDoc.Ref.Collection(backupDocumentsCollection).Query)
+	if err != nil {
+		return fmt.Errorf("failed to read document backups: %v", err)
+	}
+
+	batch := s.firestoreClient.Batch()
+	batchSize := 0
+	restored := 0
+	deleted := 0
+
+	for _, doc := range docs {
+		var backup DocumentBackup
+		if err := doc.DataTo(&backup); err != nil {
+			return fmt.Errorf("failed to parse document backup %s: %v", doc.Ref.ID, err)
+		}
+
+		ref := s.firestoreClient.Doc(backup.Path)
+		if ref == nil {
+			return fmt.Errorf("invalid document path in backup: %s", backup.Path)
+		}
+		if backup.Existed {
+			batch.Set(ref, backup.Data)
+			restored++
+		} else {
+			batch.Delete(ref)
+			deleted++
+		}
+
+		batchSize++
+		if batchSize == maxBackupBatchSize {
+			if err := commitBatch(ctx, batch); err != nil {
+				return fmt.Errorf("failed to commit rollback batch: %v", err)
+			}
+			batch = s.firestoreClient.Batch()
+			batchSize = 0
+		}
+	}
+
+	if batchSize > 0 {
+		if err := commitBatch(ctx, batch); err != nil {
+			return fmt.Errorf("failed to commit rollback batch: %v", err)
+		}
+	}
+
+	err = retry.Do(ctx, "mark backup run as rolled back", func(ctx context.Context) error {
+		_, err := runRef.Update(ctx, []firestore.Update{{Path: "rolledBackAt", Value: time.Now()}})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark backup run as rolled back: %v", err)
+	}
+
+	logger.LogInfoWithFields("Completed rollback", logrus.Fields{
+		"RunId":    runId,
+		"Restored": restored,
+		"Deleted":  deleted,
+	})
+	return nil
+}
+
+// relativeDocumentPath strips the projects/{p}/databases/{d}/documents prefix
+// from a document reference path.
+func relativeDocumentPath(ref *firestore.DocumentRef) string {
+	path := ref.Path
+	if i := strings.Index(path, "/documents/"); i >= 0 {
+		return path[i+len("/documents/"):]
+	}
+	return path
+}
+
+// backupDocumentID flattens a document path into a valid document ID.
+func backupDocumentID(path string) string {
+	return strings.ReplaceAll(path, "/", "|")
+}
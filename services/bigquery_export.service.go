@@ -0,0 +1,218 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/models"
+	"wander-wallet-tools/retry"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// BigQueryWriteMode selects what happens to rows already in the run date's
+// partition: append keeps them, overwrite replaces them.
+type BigQueryWriteMode string
+
+const (
+	BigQueryAppend    BigQueryWriteMode = "append"
+	BigQueryOverwrite BigQueryWriteMode = "overwrite"
+)
+
+func ParseBigQueryWriteMode(name string) (BigQueryWriteMode, error) {
+	for _, mode := range []BigQueryWriteMode{BigQueryAppend, BigQueryOverwrite} {
+		if string(mode) == name {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("unknown write mode %q, expected append or overwrite", name)
+}
+
+type BigQueryExportOptions struct {
+	Dataset string
+	Mode    BigQueryWriteMode
+	// RunDate is the day partition the rows are written to
+	RunDate time.Time
+}
+
+// bigqueryExports are the collections exported and the models their table
+// schemas are derived from.
+var bigqueryExports = []struct {
+	collection string
+	table      string
+	model      reflect.Type
+}{
+	{"cost-of-living", "cost_of_living", reflect.TypeOf(models.CostOfLiving{})},
+	{"cost-of-living-analytics", "cost_of_living_analytics", reflect.TypeOf(models.CostOfLivingAnalytics{})},
+	{"location-mappings", "location_mappings", reflect.TypeOf(models.LocationMapping{})},
+	{"top-destinations", "top_destinations", reflect.TypeOf(models.TopDestination{})},
+}
+
+// BigQueryExportService copies collections into day-partitioned BigQuery
+// tables for analysis.
+type BigQueryExportService struct {
+	bigqueryClient  *bigquery.Client
+	firestoreClient *firestore.Client
+}
+
+func NewBigQueryExportService(bigqueryClient *bigquery.Client, firestoreClient *firestore.Client) *BigQueryExportService {
+	return &BigQueryExportService{
+		bigqueryClient:  bigqueryClient,
+		firestoreClient: firestoreClient,
+	}
+}
+
+// ExportToBigQuery loads every exported collection into the partition of the
+// run date of its table, creating the dataset and tables as needed. Each row
+// has the document ID in a documentId column next to the model's fields. An
+// overwrite empties the partition of a collection that has no documents.
+func (s *BigQueryExportService) ExportToBigQuery(ctx context.Context, options BigQueryExportOptions) error {
+	logger.LogInfoWithFields("Starting BigQuery export", logrus.Fields{
+		"Dataset": options.Dataset,
+		"Mode":    options.Mode,
+		"RunDate": options.RunDate.Format(datasetVersionLayout),
+	})
+
+	dataset := s.bigqueryClient.Dataset(options.Dataset)
+	if err := s.ensureDataset(ctx, dataset); err != nil {
+		return err
+	}
+
+	for _, export := range bigqueryExports {
+		rows, err := s.exportCollection(ctx, dataset, export.collection, export.table, export.model, options)
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %v", export.collection, err)
+		}
+		logger.LogInfoWithFields("Exported collection to BigQuery", logrus.Fields{
+			"Collection": export.collection,
+			"Table":      export.table,
+			"Rows":       rows,
+		})
+	}
+	return nil
+}
+
+func (s *BigQueryExportService) ensureDataset(ctx context.Context, dataset *bigquery.Dataset) error {
+	_, err := dataset.Metadata(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		err = dataset.Create(ctx, &bigquery.DatasetMetadata{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to prepare dataset %s: %v", dataset.DatasetID, err)
+	}
+	return nil
+}
+
+func (s *BigQueryExportService) exportCollection(ctx context.Context, dataset *bigquery.Dataset, collection, table string, model reflect.Type, options BigQueryExportOptions) (int, error) {
+	schema, err := bigquerySchema(model)
+	if err != nil {
+		return 0, err
+	}
+	schema = append(bigquery.Schema{{Name: "documentId", Type: bigquery.StringFieldType, Required: true}}, schema...)
+
+	docs, err := queryAllDocuments(ctx, s.firestoreClient.Collection(collection).Query)
+	if err != nil {
+		return 0, err
+	}
+	partition := partitionTable(table, options.RunDate)
+	if len(docs) == 0 {
+		// There are no rows to replace the partition with, so an overwrite
+		// empties it by deleting it
+		if options.Mode == BigQueryOverwrite {
+			return 0, s.deletePartition(ctx, dataset, partition)
+		}
+		return 0, nil
+	}
+
+	var rows bytes.Buffer
+	encoder := json.NewEncoder(&rows)
+	for _, doc := range docs {
+		value := reflect.New(model)
+		if err := doc.DataTo(value.Interface()); err != nil {
+			return 0, fmt.Errorf("failed to parse %s: %v", doc.Ref.ID, err)
+		}
+		row := bigqueryRow(value.Elem())
+		row["documentId"] = doc.Ref.ID
+		if err := encoder.Encode(row); err != nil {
+			return 0, fmt.Errorf("failed to encode %s: %v", doc.Ref.ID, err)
+		}
+	}
+
+	// The job ID stays the same across retries, so a retry after a start
+	// whose response was lost finds the job instead of loading the rows twice
+	jobID := fmt.Sprintf("export_%s_%s_%d", table, options.RunDate.Format("20060102"), time.Now().UnixNano())
+	var job *bigquery.Job
+	err = retry.Do(ctx, "start loading "+table+" into BigQuery", func(ctx context.Context) error {
+		source := bigquery.NewReaderSource(bytes.NewReader(rows.Bytes()))
+		source.SourceFormat = bigquery.JSON
+		source.Schema = schema
+
+		loader := dataset.Table(partition).LoaderFrom(source)
+		loader.JobID = jobID
+		loader.CreateDisposition = bigquery.CreateIfNeeded
+		loader.WriteDisposition = bigquery.WriteAppend
+		if options.Mode == BigQueryOverwrite {
+			loader.WriteDisposition = bigquery.WriteTruncate
+		}
+		loader.TimePartitioning = &bigquery.TimePartitioning{Type: bigquery.DayPartitioningType}
+		// Models gain fields over time; let the load add their columns
+		loader.SchemaUpdateOptions = []string{"ALLOW_FIELD_ADDITION"}
+
+		var err error
+		job, err = loader.Run(ctx)
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+			job, err = s.bigqueryClient.JobFromID(ctx, jobID)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Only waiting is retried here; the job is never started again
+	err = retry.Do(ctx, "wait for the "+table+" load", func(ctx context.Context) error {
+		status, err := job.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		return status.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// deletePartition removes the rows of one day partition. A table that does
+// not exist yet has nothing to remove.
+func (s *BigQueryExportService) deletePartition(ctx context.Context, dataset *bigquery.Dataset, partition string) error {
+	err := retry.Do(ctx, "delete partition "+partition, func(ctx context.Context) error {
+		return dataset.Table(partition).Delete(ctx)
+	})
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete partition %s: %v", partition, err)
+	}
+	return nil
+}
+
+// partitionTable names the day partition of the table for the run date. The
+// partition decorator limits an overwrite to that day.
+func partitionTable(table string, runDate time.Time) string {
+	return fmt.Sprintf("%s$%s", table, runDate.Format("20060102"))
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"wander-wallet-tools/models"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/firestore"
+)
+
+func fixtureAnalytics() models.CostOfLivingAnalytics {
+	return models.CostOfLivingAnalytics{
+		City:           "Lisbon",
+		Country:        "Portugal",
+		DatasetVersion: "2026-01-01",
+		DataQuality:    1,
+		Scores:         models.Scores{Overall: 42.5, Apt1BedCityCenter: 61},
+		Imputed: map[string]models.ImputedValue{
+			"milk1L": {Value: 1.1, Method: "country-median"},
+		},
+		CountryScores: map[string]float64{"apt1BedCityCenter": 30},
+		SimilarCities: []models.SimilarCity{
+			{City: "Porto", Country: "Portugal", Similarity: 0.93, Overall: 38},
+		},
+		PriceTier: "$$",
+		Cluster:   &models.CostCluster{Id: 2, Clusters: 6, Level: 45.2, Profile: "cheap housing"},
+		Trend:     &models.CostOfLivingTrend{BaselineVersion: "2025-01-01", Years: 1, Inflation: math.NaN()},
+		StatsRef: &firestore.DocumentRef{
+			ID:   "2026-01-01",
+			Path: "projects/wander-wallet/databases/(default)/documents/cost-of-living-stats/2026-01-01",
+		},
+	}
+}
+
+// schemaField finds a field by its dotted path through nested records.
+func schemaField(schema bigquery.Schema, path ...string) *bigquery.FieldSchema {
+	for _, field := range schema {
+		if field.Name != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return field
+		}
+		return schemaField(field.Schema, path[1:]...)
+	}
+	return nil
+}
+
+// checkRowColumns fails the test for any row column the schema does not
+// have, as a load job would.
+func checkRowColumns(t *testing.T, row map[string]interface{}, schema bigquery.Schema, prefix string) {
+	t.Helper()
+	for name, value := range row {
+		field := schemaField(schema, name)
+		if field == nil {
+			t.Errorf("row column %s%s is not in the schema", prefix, name)
+			continue
+		}
+		records := []interface{}{value}
+		if values, ok := value.([]interface{}); ok {
+			records = values
+		}
+		for _, record := range records {
+			if nested, ok := record.(map[string]interface{}); ok {
+				checkRowColumns(t, nested, field.Schema, prefix+name+".")
+			}
+		}
+	}
+}
+
+func TestBigQuerySchemaOfAnalytics(t *testing.T) {
+	schema, err := bigquerySchema(reflect.TypeOf(models.CostOfLivingAnalytics{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path      []string
+		fieldType bigquery.FieldType
+		repeated  bool
+	}{
+		{[]string{"city"}, bigquery.StringFieldType, false},
+		{[]string{"dataQuality"}, bigquery.IntegerFieldType, false},
+		{[]string{"scores"}, bigquery.RecordFieldType, false},
+		{[]string{"scores", "overall"}, bigquery.FloatFieldType, false},
+		{[]string{"countryScores"}, bigquery.RecordFieldType, true},
+		{[]string{"countryScores", "key"}, bigquery.StringFieldType, false},
+		{[]string{"countryScores", "value"}, bigquery.FloatFieldType, false},
+		{[]string{"imputed", "value", "method"}, bigquery.StringFieldType, false},
+		{[]string{"similarCities"}, bigquery.RecordFieldType, true},
+		{[]string{"similarCities", "similarity"}, bigquery.FloatFieldType, false},
+		{[]string{"budget", "moderate", "lines", "cost"}, bigquery.FloatFieldType, false},
+		{[]string{"budget", "moderate", "missingItems"}, bigquery.StringFieldType, true},
+		{[]string{"cluster", "id"}, bigquery.IntegerFieldType, false},
+		{[]string{"statsRef"}, bigquery.StringFieldType, false},
+	}
+	for _, test := range tests {
+		field := schemaField(schema, test.path...)
+		if field == nil {
+			t.Errorf("%v: missing from the schema", test.path)
+			continue
+		}
+		if field.Type != test.fieldType || field.Repeated != test.repeated {
+			t.Errorf("%v: got %s repeated %v, expected %s repeated %v", test.path, field.Type, field.Repeated, test.fieldType, test.repeated)
+		}
+	}
+}
+
+func TestBigQuerySchemaOfExportedModels(t *testing.T) {
+	for _, export := range bigqueryExports {
+		if _, err := bigquerySchema(export.model); err != nil {
+			t.Errorf("%s: %v", export.collection, err)
+		}
+	}
+}
+
+func TestBigQueryRowOfAnalytics(t *testing.T) {
+	schema, err := bigquerySchema(reflect.TypeOf(models.CostOfLivingAnalytics{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := bigqueryRow(reflect.ValueOf(fixtureAnalytics()))
+	checkRowColumns(t, row, schema, "")
+
+	if got := row["city"]; got != "Lisbon" {
+		t.Errorf("city = %v, expected Lisbon", got)
+	}
+	if got := row["statsRef"]; got != "cost-of-living-stats/2026-01-01" {
+		t.Errorf("statsRef = %v, expected the relative document path", got)
+	}
+	if got := row["budget"]; got != nil {
+		t.Errorf("budget = %v, expected nil for a nil pointer", got)
+	}
+	if got := row["scores"].(map[string]interface{})["overall"]; got != 42.5 {
+		t.Errorf("scores.overall = %v, expected 42.5", got)
+	}
+	if got := row["trend"].(map[string]interface{})["inflation"]; got != nil {
+		t.Errorf("trend.inflation = %v, expected nil for NaN", got)
+	}
+
+	expectedCountryScores := []interface{}{map[string]interface{}{"key": "apt1BedCityCenter", "value": 30.0}}
+	if got := row["countryScores"]; !reflect.DeepEqual(got, expectedCountryScores) {
+		t.Errorf("countryScores = %v, expected %v", got, expectedCountryScores)
+	}
+	similar := row["similarCities"].([]interface{})
+	if len(similar) != 1 || similar[0].(map[string]interface{})["city"] != "Porto" {
+		t.Errorf("similarCities = %v, expected Porto", similar)
+	}
+
+	// Load jobs read the rows as JSON
+	if _, err := json.Marshal(row); err != nil {
+		t.Errorf("row does not encode as JSON: %v", err)
+	}
+}
+
+func TestPartitionTable(t *testing.T) {
+	runDate := time.Date(2026, time.March, 7, 23, 30, 0, 0, time.UTC)
+	if got := partitionTable("cost_of_living", runDate); got != "cost_of_living$20260307" {
+		t.Errorf("partitionTable = %s, expected cost_of_living$20260307", got)
+	}
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/firestore"
+)
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	documentRefType = reflect.TypeOf(&firestore.DocumentRef{})
+)
+
+// bigqueryColumns lists the exported struct fields of t under the name
+// Firestore stores them by, which is also their BigQuery column name.
+func bigqueryColumns(t reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("firestore"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		field.Name = name
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// bigquerySchema derives a table schema from a model struct: strings,
+// numbers, booleans and timestamps map to their BigQuery types, document
+// references to their path, slices to repeated fields, nested structs to
+// records, and maps to repeated key/value records.
+func bigquerySchema(t reflect.Type) (bigquery.Schema, error) {
+	var schema bigquery.Schema
+	for _, field := range bigqueryColumns(t) {
+		fieldSchema, err := bigqueryField(field.Name, field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", t.Name(), field.Name, err)
+		}
+		schema = append(schema, fieldSchema)
+	}
+	return schema, nil
+}
+
+func bigqueryField(name string, t reflect.Type) (*bigquery.FieldSchema, error) {
+	field := &bigquery.FieldSchema{Name: name}
+
+	if t == documentRefType {
+		field.Type = bigquery.StringFieldType
+		return field, nil
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		field.Type = bigquery.TimestampFieldType
+	case t.Kind() == reflect.String:
+		field.Type = bigquery.StringFieldType
+	case t.Kind() == reflect.Bool:
+		field.Type = bigquery.BooleanFieldType
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		field.Type = bigquery.IntegerFieldType
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		field.Type = bigquery.FloatFieldType
+	case t.Kind() == reflect.Slice:
+		element, err := bigqueryField(name, t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		if element.Repeated {
+			return nil, fmt.Errorf("nested repeated fields are not supported")
+		}
+		element.Repeated = true
+		return element, nil
+	case t.Kind() == reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map keys must be strings")
+		}
+		value, err := bigqueryField("value", t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		field.Type = bigquery.RecordFieldType
+		field.Repeated = true
+		field.Schema = bigquery.Schema{{Name: "key", Type: bigquery.StringFieldType}, value}
+	case t.Kind() == reflect.Struct:
+		schema, err := bigquerySchema(t)
+		if err != nil {
+			return nil, err
+		}
+		field.Type = bigquery.RecordFieldType
+		field.Schema = schema
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+	return field, nil
+}
+
+// bigqueryRow converts a model struct to a row matching bigquerySchema,
+// ready to be encoded as JSON for a load job.
+func bigqueryRow(v reflect.Value) map[string]interface{} {
+	row := make(map[string]interface{})
+	for _, field := range bigqueryColumns(v.Type()) {
+		row[field.Name] = bigqueryValue(v.FieldByIndex(field.Index))
+	}
+	return row
+}
+
+func bigqueryValue(v reflect.Value) interface{} {
+	if v.Type() == documentRefType {
+		if v.IsNil() {
+			return nil
+		}
+		return relativeDocumentPath(v.Interface().(*firestore.DocumentRef))
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch {
+	case v.Type() == timeType:
+		t := v.Interface().(time.Time)
+		if t.IsZero() {
+			return nil
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+		// JSON has no NaN or infinity
+		if f := v.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil
+		}
+		return v.Interface()
+	case v.Kind() == reflect.Slice:
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = bigqueryValue(v.Index(i))
+		}
+		return values
+	case v.Kind() == reflect.Map:
+		entries := make([]interface{}, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			entries = append(entries, map[string]interface{}{
+				"key":   iter.Key().String(),
+				"value": bigqueryValue(iter.Value()),
+			})
+		}
+		return entries
+	case v.Kind() == reflect.Struct:
+		return bigqueryRow(v)
+	default:
+		return v.Interface()
+	}
+}
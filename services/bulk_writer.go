@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/time/rate"
+)
+
+// BulkWriterOptions controls the write rate of a BulkWriter. Writes start at
+// InitialOpsPerSecond and grow by RampUpMultiplier every RampUpInterval,
+// which with the defaults is Firestore's 500/50/5 ramp-up rule: start at 500
+// operations per second and increase by 50% every 5 minutes.
+type BulkWriterOptions struct {
+	InitialOpsPerSecond float64
+	MaxOpsPerSecond     float64 // 0 means no ceiling
+	RampUpInterval      time.Duration
+	RampUpMultiplier    float64
+}
+
+func DefaultBulkWriterOptions() BulkWriterOptions {
+	return BulkWriterOptions{
+		InitialOpsPerSecond: 500,
+		RampUpInterval:      5 * time.Minute,
+		RampUpMultiplier:    1.5,
+	}
+}
+
+type BulkWriteFailure struct {
+	Path string
+	Err  error
+}
+
+type BulkWriteResult struct {
+	Succeeded int
+	Failures  []BulkWriteFailure
+}
+
+type bulkWrite struct {
+	path string
+	job  *firestore.BulkWriterJob
+}
+
+// BulkWriter wraps firestore.BulkWriter, which sends writes in parallel
+// batches and retries individual failed writes, with a ramp-up rate limiter.
+// Unlike a WriteBatch, one failing document does not fail the others; each
+// failure is reported on its own by Flush and End.
+type BulkWriter struct {
+	ctx     context.Context
+	writer  *firestore.BulkWriter
+	limiter *rate.Limiter
+	options BulkWriterOptions
+	start   time.Time
+
+	mu      sync.Mutex
+	pending []bulkWrite
+}
+
+func NewBulkWriter(ctx context.Context, client *firestore.Client, options BulkWriterOptions) *BulkWriter {
+	w := &BulkWriter{
+		ctx:     ctx,
+		writer:  client.BulkWriter(ctx),
+		options: options,
+		start:   time.Now(),
+	}
+	w.limiter = rate.NewLimiter(rate.Limit(w.currentLimit()), 1)
+	return w
+}
+
+func (w *BulkWriter) Set(ref *firestore.DocumentRef, data interface{}) error {
+	if err := w.wait(); err != nil {
+		return err
+	}
+	job, err := w.writer.Set(ref, data)
+	if err != nil {
+		return err
+	}
+	w.track(ref, job)
+	return nil
+}
+
+func (w *BulkWriter) Delete(ref *firestore.DocumentRef) error {
+	if err := w.wait(); err != nil {
+		return err
+	}
+	job, err := w.writer.Delete(ref)
+	if err != nil {
+		return err
+	}
+	w.track(ref, job)
+	return nil
+}
+
+// Flush blocks until every write enqueued so far has finished and returns
+// their outcome.
+func (w *BulkWriter) Flush() BulkWriteResult {
+	w.writer.Flush()
+	return w.collect()
+}
+
+// End flushes the remaining writes and closes the writer.
+func (w *BulkWriter) End() BulkWriteResult {
+	w.writer.End()
+	return w.collect()
+}
+
+func (w *BulkWriter) track(ref *firestore.DocumentRef, job *firestore.BulkWriterJob) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, bulkWrite{path: relativeDocumentPath(ref), job: job})
+}
+
+func (w *BulkWriter) collect() BulkWriteResult {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	var result BulkWriteResult
+	for _, write := range pending {
+		if _, err := write.job.Results(); err != nil {
+			result.Failures = append(result.Failures, BulkWriteFailure{Path: write.path, Err: err})
+			continue
+		}
+		result.Succeeded++
+	}
+	return result
+}
+
+func (w *BulkWriter) wait() error {
+	limit := rate.Limit(w.currentLimit())
+	if w.limiter.Limit() != limit {
+		w.limiter.SetLimit(limit)
+	}
+	return w.limiter.Wait(w.ctx)
+}
+
+func (w *BulkWriter) currentLimit() float64 {
+	limit := w.options.InitialOpsPerSecond
+	if w.options.RampUpInterval > 0 && w.options.RampUpMultiplier > 1 {
+		steps := float64(time.Since(w.start) / w.options.RampUpInterval)
+		limit *= math.Pow(w.options.RampUpMultiplier, steps)
+	}
+	if w.options.MaxOpsPerSecond > 0 && limit > w.options.MaxOpsPerSecond {
+		limit = w.options.MaxOpsPerSecond
+	}
+	return limit
+}
@@ -4,99 +4,231 @@ import (
 	"context"
 	"fmt"
 	"math"
-	"reflect"
+	"runtime"
 	"sort"
-	"wander-wallet-tools/utils"
+	"strings"
+	"sync"
+	"time"
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/models"
 
 	"cloud.google.com/go/firestore"
-	"google.golang.org/api/iterator"
+	"github.com/sirupsen/logrus"
 )
 
-type CostOfLiving struct {
-	City                      string  `firestore:"city"`
-	Country                   string  `firestore:"country"`
-	MealInexpensiveRestaurant float64 `firestore:"mealInexpensiveRestaurant"`
-	MealFor2MidRange          float64 `firestore:"mealFor2MidRange"`
-	ComboMealMcdonalds        float64 `firestore:"comboMealMcdonalds"`
-	DomesticBeerRestaurant    float64 `firestore:"domesticBeerRestaurant"`
-	ImportedBeerRestaurant    float64 `firestore:"importedBeerRestaurant"`
-	CappuccinoRestaurant      float64 `firestore:"cappuccinoRestaurant"`
-	SodaRestaurant            float64 `firestore:"sodaRestaurant"`
-	WaterRestaurant           float64 `firestore:"waterRestaurant"`
-	WineMidRange              float64 `firestore:"wineMidRange"`
-	DomesticBeerMarket        float64 `firestore:"domesticBeerMarket"`
-	ImportedBeerMarket        float64 `firestore:"importedBeerMarket"`
-	CigarettesPack            float64 `firestore:"cigarettesPack"`
-	TicketOneWay              float64 `firestore:"ticketOneWay"`
-	MonthlyPass               float64 `firestore:"monthlyPass"`
-	TaxiStart                 float64 `firestore:"taxiStart"`
-	Taxi1Km                   float64 `firestore:"taxi1Km"`
-	Gasoline1L                float64 `firestore:"gasoline1L"`
-	Utilities85sqmApartment   float64 `firestore:"utilities85sqmApartment"`
-	MobileTariff1Min          float64 `firestore:"mobileTariff1Min"`
-	InternetUnlimited         float64 `firestore:"internetUnlimited"`
-	FitnessClubMonthly        float64 `firestore:"fitnessClubMonthly"`
-	Apt1BedCityCenter         float64 `firestore:"apt1BedCityCenter"`
-	Apt1BedOutsideCenter      float64 `firestore:"apt1BedOutsideCenter"`
-	Apt3BedCityCenter         float64 `firestore:"apt3BedCityCenter"`
-	Apt3BedOutsideCenter      float64 `firestore:"apt3BedOutsideCenter"`
-	PricePerSqmCityCenter     float64 `firestore:"pricePerSqmCityCenter"`
-	PricePerSqmOutsideCenter  float64 `firestore:"pricePerSqmOutsideCenter"`
-	AvgNetSalary              float64 `firestore:"avgNetSalary"`
+type CostOfLivingAnalyzerOptions struct {
+	Workers          int // metrics analyzed in parallel; 1 or less runs sequentially
+	PercentileMethod PercentileMethod
+	WeightProfiles   []WeightProfile // each adds an overall score for its persona
+	Categories       []MetricCategory
+	// MinPeerCount is the number of cities in a country or continent that
+	// must report a metric before it is ranked within that scope
+	MinPeerCount int
+	// IndexBaseCity and IndexBaseCountry name the city whose indices are 100
+	IndexBaseCity    string
+	IndexBaseCountry string
+	BudgetBasket     []BasketItem // priced per city when set
+	// DatasetVersion identifies the cost-of-living data the run analyzed and
+	// is the ID of its cost-of-living-stats document. Empty keeps the version
+	// of the previous run, or uses today's date on the first run.
+	DatasetVersion string
+	// Impute fills in metrics a city does not report so they count towards
+	// its scores. Imputed values are never part of the distributions.
+	Impute bool
+	// SimilarCities is the number of nearest neighbours stored per city; 0
+	// leaves them out. Finding them compares every pair of cities, which is
+	// quadratic in the number of cities, so they are opt-in.
+	SimilarCities     int
+	SimilarityMeasure SimilarityMeasure
+	// SimilarityWeights weighs each metric when comparing cities; nil weighs
+	// every metric equally and metrics without a weight are ignored
+	SimilarityWeights map[string]float64
+	// MaxClusters is the largest number of cost clusters tried; fewer than 4
+	// leaves cities unclustered. Clustering runs k-means for every count
+	// tried, which takes seconds on the full dataset, so it is opt-in.
+	MaxClusters int
 }
 
-type MetricStats struct {
-	Mean              float64 `firestore:"mean"`
-	Median            float64 `firestore:"median"`
-	Mode              float64 `firestore:"mode"`
-	StandardDeviation float64 `firestore:"standardDeviation"`
+// CostOfLivingAnalysis is the result of an analyzer run: the analytics of
+// every city and the stats of the distributions they were ranked against.
+// Snapshots are the source data stored under the dataset version, so later
+// versions can measure trends against it.
+type CostOfLivingAnalysis struct {
+	Cities    []models.CostOfLivingAnalytics
+	Stats     models.CostOfLivingStats
+	Snapshots []models.CostOfLiving
 }
 
-type CostOfLivingAnalytics struct {
-	City    string                 `firestore:"city"`
-	Country string                 `firestore:"country"`
-	Scores  map[string]float64     `firestore:"scores"`
-	Stats   map[string]MetricStats `firestore:"stats"`
+func DefaultCostOfLivingAnalyzerOptions() CostOfLivingAnalyzerOptions {
+	return CostOfLivingAnalyzerOptions{
+		Workers:           runtime.NumCPU(),
+		PercentileMethod:  PercentileMidRank,
+		MinPeerCount:      5,
+		IndexBaseCity:     "New York",
+		IndexBaseCountry:  "United States",
+		SimilarityMeasure: SimilarityCosine,
+	}
 }
 
 type CostOfLivingAnalyzerService struct {
 	firestoreClient *firestore.Client
+	options         CostOfLivingAnalyzerOptions
 }
 
-func NewCostOfLivingAnalyzerService(client *firestore.Client) *CostOfLivingAnalyzerService {
+func NewCostOfLivingAnalyzerService(client *firestore.Client, options CostOfLivingAnalyzerOptions) *CostOfLivingAnalyzerService {
 	return &CostOfLivingAnalyzerService{
 		firestoreClient: client,
+		options:         options,
 	}
 }
 
-func (s *CostOfLivingAnalyzerService) AnalyzeAndStoreData(ctx context.Context) error {
+// AnalyzeAndStoreData analyzes the cost-of-living collection and stores the
+// analytics, doing as little work as the changes since the last run allow:
+//
+//   - nothing changed: the run is skipped
+//   - sources changed but no metric's distribution shifted meaningfully:
+//     only the changed cities are scored and written
+//   - distributions shifted: every city is scored, and cities whose source
+//     and scores are unchanged are not written
+//   - options changed, or no previous run: every city is scored and written
+//   - a new dataset version was given: every city is scored and written,
+//     with a stats document and snapshots under the new version, even if
+//     nothing else changed
+//
+// force always scores and writes every city. Snapshots are only written on
+// the first run and with a new dataset version, so a version's snapshots stay
+// the data it was first stored with; data that changed later is snapshotted
+// by giving a new version.
+func (s *CostOfLivingAnalyzerService) AnalyzeAndStoreData(ctx context.Context, force bool) error {
 	colData, err := s.retrieveAllCostOfLivingData(ctx, s.firestoreClient)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve data: %v", err)
 	}
 
-	relativeScores := s.analyzeData(colData)
+	optionsFingerprint := s.optionsFingerprint()
+	fingerprint := datasetFingerprint(colData, optionsFingerprint)
+
+	state, err := s.loadState(ctx)
+	if err != nil {
+		return err
+	}
+	newVersion := s.resolveDatasetVersion(state)
+	if !force && !newVersion && state != nil && state.Fingerprint == fingerprint {
+		logger.LogInfoWithFields("Cost-of-living data unchanged since the last analysis, skipping", logrus.Fields{
+			"DatasetVersion": state.DatasetVersion,
+			"Cities":         state.Cities,
+		})
+		return nil
+	}
+
+	results := s.analyzeMetrics(colData)
+	stats := s.metricStats(colData, results)
+
+	rewriteAll := force || newVersion || state == nil || state.OptionsFingerprint != optionsFingerprint
+	incremental := !rewriteAll && !distributionsShifted(state.Metrics, stats.Metrics)
+
+	stored := make(map[string]models.CostOfLivingAnalytics)
+	if !rewriteAll {
+		stored, err = s.retrieveStoredAnalytics(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve stored analytics: %v", err)
+		}
+	}
+
+	// Cities whose source changed always need their analytics rewritten
+	changed := make([]bool, len(colData))
+	for i, col := range colData {
+		previous, ok := stored[models.GetCostOfLivingAnalyticsPath(col.City, col.Country)]
+		changed[i] = rewriteAll || !ok || previous.SourceHash != sourceHash(col)
+	}
+
+	var analysis CostOfLivingAnalysis
+	if incremental {
+		analysis = s.assemble(colData, results, stats, changed)
+	} else {
+		analysis = s.assemble(colData, results, stats, nil)
+		if !rewriteAll {
+			moved := analysis.Cities[:0]
+			for i, analytics := range analysis.Cities {
+				previous := stored[models.GetCostOfLivingAnalyticsPath(analytics.City, analytics.Country)]
+				if changed[i] || scoresMoved(previous, analytics) {
+					moved = append(moved, analytics)
+				}
+			}
+			analysis.Cities = moved
+		}
+	}
+
+	baseline, err := s.loadTrendBaseline(ctx)
+	if err != nil {
+		return err
+	}
+	if baseline != nil {
+		sources := make(map[string]models.CostOfLiving, len(colData))
+		for _, col := range colData {
+			sources[cityId(col.City, col.Country)] = col
+		}
+		for i, analytics := range analysis.Cities {
+			analysis.Cities[i].Trend = s.computeTrend(sources[cityId(analytics.City, analytics.Country)], baseline)
+		}
+	}
 
-	err = s.storeRelativeScores(ctx, s.firestoreClient, relativeScores)
+	if state == nil || newVersion {
+		analysis.Snapshots = colData
+	} else {
+		logger.LogInfoWithFields("Keeping the snapshots of the dataset version, give a new version to snapshot changed data", logrus.Fields{
+			"DatasetVersion": s.options.DatasetVersion,
+		})
+	}
+
+	logger.LogInfoWithFields("Analyzed cost-of-living data", logrus.Fields{
+		"Cities":      len(colData),
+		"ToWrite":     len(analysis.Cities),
+		"RewriteAll":  rewriteAll,
+		"Incremental": incremental,
+	})
+
+	err = s.storeRelativeScores(ctx, s.firestoreClient, analysis)
 	if err != nil {
 		return fmt.Errorf("failed to store relative scores: %v", err)
 	}
 
-	return nil
+	return s.saveState(ctx, AnalyzerState{
+		Fingerprint:        fingerprint,
+		OptionsFingerprint: optionsFingerprint,
+		DatasetVersion:     s.options.DatasetVersion,
+		Cities:             len(colData),
+		Metrics:            stats.Metrics,
+	})
 }
 
-func (s *CostOfLivingAnalyzerService) retrieveAllCostOfLivingData(ctx context.Context, client *firestore.Client) ([]CostOfLiving, error) {
-	var colData []CostOfLiving
-	iter := client.Collection("cost-of-living").Documents(ctx)
-	for {
-		doc, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, err
+// retrieveStoredAnalytics returns the current analytics documents keyed by
+// document path.
+func (s *CostOfLivingAnalyzerService) retrieveStoredAnalytics(ctx context.Context) (map[string]models.CostOfLivingAnalytics, error) {
+	docs, err := queryAllDocuments(ctx, s.firestoreClient.Collection("cost-of-living-analytics").Query)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]models.CostOfLivingAnalytics, len(docs))
+	for _, doc := range docs {
+		var analytics models.CostOfLivingAnalytics
+		if err := doc.DataTo(&analytics); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", doc.Ref.ID, err)
 		}
-		var col CostOfLiving
+		stored[relativeDocumentPath(doc.Ref)] = analytics
+	}
+	return stored, nil
+}
+
+func (s *CostOfLivingAnalyzerService) retrieveAllCostOfLivingData(ctx context.Context, client *firestore.Client) ([]models.CostOfLiving, error) {
+	var colData []models.CostOfLiving
+	docs, err := queryAllDocuments(ctx, client.Collection("cost-of-living").Query)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		var col models.CostOfLiving
 		err = doc.DataTo(&col)
 		if err != nil {
 			return nil, err
@@ -106,196 +238,399 @@ func (s *CostOfLivingAnalyzerService) retrieveAllCostOfLivingData(ctx context.Co
 	return colData, nil
 }
 
-func (s *CostOfLivingAnalyzerService) analyzeData(colData []CostOfLiving) []CostOfLivingAnalytics {
-	metricsToAnalyze := s.getPropertyNames(CostOfLiving{})
-	var relativeScores []CostOfLivingAnalytics
+// metricDistribution holds the sorted reported values of one metric across
+// all cities. Missing values (0) are left out.
+type metricDistribution struct {
+	values []float64
+}
+
+func newMetricDistribution(cityValues []float64) metricDistribution {
+	values := make([]float64, 0, len(cityValues))
+	for _, value := range cityValues {
+		if value > 0 {
+			values = append(values, value)
+		}
+	}
+	sort.Float64s(values)
+	return metricDistribution{values: values}
+}
 
-	for _, location := range colData {
-		scores := make(map[string]float64)
-		stats := make(map[string]MetricStats)
+// percentile ranks value against the distribution with the given method.
+// The block of values equal to value is found by two binary searches.
+func (d metricDistribution) percentile(value float64, method PercentileMethod) float64 {
+	below := sort.SearchFloat64s(d.values, value)
+	end := below + sort.Search(len(d.values)-below, func(i int) bool { return d.values[below+i] > value })
+	return method.rank(below, end-below, len(d.values))
+}
+
+// quantile returns the q-th quantile (0 to 1) of the distribution,
+// interpolating linearly between the two nearest values.
+func (d metricDistribution) quantile(q float64) float64 {
+	return sortedQuantile(d.values, q)
+}
+
+func (d metricDistribution) stats() models.MetricStats {
+	n := float64(len(d.values))
+	sum := 0.0
+	for _, v := range d.values {
+		sum += v
+	}
+	mean := sum / n
+
+	variance := 0.0
+	for _, v := range d.values {
+		variance += (v - mean) * (v - mean)
+	}
+
+	median := d.quantile(0.5)
+	deviations := make([]float64, len(d.values))
+	for i, v := range d.values {
+		deviations[i] = math.Abs(v - median)
+	}
+	sort.Float64s(deviations)
+
+	stats := models.MetricStats{
+		Count:  int64(len(d.values)),
+		Min:    d.values[0],
+		Max:    d.values[len(d.values)-1],
+		Mean:   mean,
+		Median: median,
+		P10:    d.quantile(0.1),
+		P25:    d.quantile(0.25),
+		P75:    d.quantile(0.75),
+		P90:    d.quantile(0.9),
+		StdDev: math.Sqrt(variance / n),
+		MAD:    sortedQuantile(deviations, 0.5),
+	}
+	stats.IQR = stats.P75 - stats.P25
+	return stats
+}
+
+func sortedQuantile(values []float64, q float64) float64 {
+	position := q * float64(len(values)-1)
+	lower := int(math.Floor(position))
+	upper := int(math.Ceil(position))
+	return values[lower] + (values[upper]-values[lower])*(position-float64(lower))
+}
+
+// metricResult is the analysis of one metric: its distribution stats and the
+// percentile of every city, indexed like the input, with NaN for cities that
+// do not report the metric and could not be imputed. The scoped percentiles
+// rank each city within its country and continent, with NaN also where there
+// are too few peers.
+type metricResult struct {
+	stats                models.MetricStats
+	percentiles          []float64
+	imputed              map[int]models.ImputedValue // by city index
+	countryPercentiles   []float64
+	continentPercentiles []float64
+}
+
+// cityScopes groups city indexes by country and by continent code. Cities
+// with an unknown continent are left out of the continent groups.
+type cityScopes struct {
+	countries  [][]int
+	continents [][]int
+}
+
+func newCityScopes(colData []models.CostOfLiving) cityScopes {
+	countries := make(map[string][]int)
+	continents := make(map[string][]int)
+	for i, col := range colData {
+		countries[col.Country] = append(countries[col.Country], i)
+		if code := models.GetCountryContinentCode(col.Country); code != "" {
+			continents[code] = append(continents[code], i)
+		}
+	}
+
+	var scopes cityScopes
+	for _, group := range countries {
+		scopes.countries = append(scopes.countries, group)
+	}
+	for _, group := range continents {
+		scopes.continents = append(scopes.continents, group)
+	}
+	return scopes
+}
+
+// AnalyzeData scores every metric of each city as its percentile among the
+// cities reporting that metric. Each metric is sorted once and cities are
+// ranked by binary search, so a run is O(metrics × cities log cities). It does
+// not touch Firestore.
+func (s *CostOfLivingAnalyzerService) AnalyzeData(colData []models.CostOfLiving) CostOfLivingAnalysis {
+	results := s.analyzeMetrics(colData)
+	return s.assemble(colData, results, s.metricStats(colData, results), nil)
+}
+
+func (s *CostOfLivingAnalyzerService) metricStats(colData []models.CostOfLiving, results []metricResult) models.CostOfLivingStats {
+	stats := models.CostOfLivingStats{
+		DatasetVersion: s.options.DatasetVersion,
+		Cities:         len(colData),
+		ComputedAt:     time.Now(),
+		Metrics:        make(map[string]models.MetricStats),
+	}
+	for m, metric := range models.CostOfLivingMetrics {
+		if results[m].stats.Count > 0 {
+			stats.Metrics[metric] = results[m].stats
+		}
+	}
+	return stats
+}
+
+// assemble builds the analytics of the cities marked in affected from the
+// per-metric results; a nil affected assembles every city. The returned
+// cities keep the input order.
+func (s *CostOfLivingAnalyzerService) assemble(colData []models.CostOfLiving, results []metricResult, stats models.CostOfLivingStats, affected []bool) CostOfLivingAnalysis {
+	indices := s.computeIndices(colData)
+	neighbours := s.similarCities(colData, results, affected)
+	clusters := s.clusterCities(colData, results)
+
+	relativeScores := make([]models.CostOfLivingAnalytics, 0, len(colData))
+	for i, location := range colData {
+		if affected != nil && !affected[i] {
+			continue
+		}
+		analytics := models.CostOfLivingAnalytics{
+			City:             location.City,
+			Country:          location.Country,
+			DatasetVersion:   s.options.DatasetVersion,
+			SourceHash:       sourceHash(location),
+			DataQuality:      location.DataQuality,
+			ContinentCode:    models.GetCountryContinentCode(location.Country),
+			PercentileMethod: string(s.options.PercentileMethod),
+			Indices:          indices[i],
+			SimilarCities:    neighbours[i],
+			Cluster:          clusters[i],
+		}
+		if clusters[i] != nil {
+			analytics.PriceTier = priceTier(*clusters[i])
+		}
+		if len(s.options.BudgetBasket) > 0 {
+			analytics.Budget = priceBasket(s.options.BudgetBasket, location)
+		}
 		var totalScore float64
 		var scoreCount int
+		reported := make(map[string]bool)
 
-		for _, metric := range metricsToAnalyze {
-			value := s.getMetricValue(location, metric)
-			if value > 0 {
-				allValues := s.getAllMetricValues(colData, metric)
-				percentile := s.calculatePercentile(allValues, value)
-				metricKey := utils.FirstLetterToLower(metric)
-				scores[metricKey] = percentile
-				stats[metricKey] = s.calculateStats(allValues)
-
-				// Add to total score for average calculation
-				totalScore += percentile
-				scoreCount++
+		for m, metric := range models.CostOfLivingMetrics {
+			percentile := results[m].percentiles[i]
+			if math.IsNaN(percentile) {
+				continue
+			}
+			analytics.Scores.Set(metric, percentile)
+			reported[metric] = true
+
+			if imputed, ok := results[m].imputed[i]; ok {
+				if analytics.Imputed == nil {
+					analytics.Imputed = make(map[string]models.ImputedValue)
+				}
+				analytics.Imputed[metric] = imputed
+			}
+
+			if countryPercentile := results[m].countryPercentiles[i]; !math.IsNaN(countryPercentile) {
+				if analytics.CountryScores == nil {
+					analytics.CountryScores = make(map[string]float64)
+				}
+				analytics.CountryScores[metric] = countryPercentile
+			}
+			if continentPercentile := results[m].continentPercentiles[i]; !math.IsNaN(continentPercentile) {
+				if analytics.ContinentScores == nil {
+					analytics.ContinentScores = make(map[string]float64)
+				}
+				analytics.ContinentScores[metric] = continentPercentile
 			}
+
+			// Add to total score for average calculation
+			totalScore += percentile
+			scoreCount++
 		}
 
 		// Calculate and add the overall score
 		if scoreCount > 0 {
-			scores["overall"] = totalScore / float64(scoreCount)
+			analytics.Scores.Overall = totalScore / float64(scoreCount)
 		}
 
-		relativeScores = append(relativeScores, CostOfLivingAnalytics{
-			City:    location.City,
-			Country: location.Country,
-			Scores:  scores,
-			Stats:   stats,
-		})
+		for _, profile := range s.options.WeightProfiles {
+			if score, ok := profile.overall(analytics.Scores, reported); ok {
+				if analytics.OverallByProfile == nil {
+					analytics.OverallByProfile = make(map[string]float64)
+				}
+				analytics.OverallByProfile[profile.Name] = score
+			}
+		}
+
+		for _, category := range s.options.Categories {
+			if score, ok := category.score(analytics.Scores, reported, analytics.Imputed); ok {
+				if analytics.Categories == nil {
+					analytics.Categories = make(map[string]models.CategoryScore)
+				}
+				analytics.Categories[category.Name] = score
+			}
+		}
+
+		relativeScores = append(relativeScores, analytics)
 	}
 
-	return relativeScores
+	return CostOfLivingAnalysis{Cities: relativeScores, Stats: stats}
 }
 
-func (s *CostOfLivingAnalyzerService) getMetricValue(col CostOfLiving, metric string) float64 {
-	switch metric {
-	case "MealInexpensiveRestaurant":
-		return col.MealInexpensiveRestaurant
-	case "MealFor2MidRange":
-		return col.MealFor2MidRange
-	case "ComboMealMcdonalds":
-		return col.ComboMealMcdonalds
-	case "DomesticBeerRestaurant":
-		return col.DomesticBeerRestaurant
-	case "ImportedBeerRestaurant":
-		return col.ImportedBeerRestaurant
-	case "CappuccinoRestaurant":
-		return col.CappuccinoRestaurant
-	case "SodaRestaurant":
-		return col.SodaRestaurant
-	case "WaterRestaurant":
-		return col.WaterRestaurant
-	case "WineMidRange":
-		return col.WineMidRange
-	case "DomesticBeerMarket":
-		return col.DomesticBeerMarket
-	case "ImportedBeerMarket":
-		return col.ImportedBeerMarket
-	case "CigarettesPack":
-		return col.CigarettesPack
-	case "TicketOneWay":
-		return col.TicketOneWay
-	case "MonthlyPass":
-		return col.MonthlyPass
-	case "TaxiStart":
-		return col.TaxiStart
-	case "Taxi1Km":
-		return col.Taxi1Km
-	case "Gasoline1L":
-		return col.Gasoline1L
-	case "Utilities85sqmApartment":
-		return col.Utilities85sqmApartment
-	case "MobileTariff1Min":
-		return col.MobileTariff1Min
-	case "InternetUnlimited":
-		return col.InternetUnlimited
-	case "FitnessClubMonthly":
-		return col.FitnessClubMonthly
-	case "Apt1BedCityCenter":
-		return col.Apt1BedCityCenter
-	case "Apt1BedOutsideCenter":
-		return col.Apt1BedOutsideCenter
-	case "Apt3BedCityCenter":
-		return col.Apt3BedCityCenter
-	case "Apt3BedOutsideCenter":
-		return col.Apt3BedOutsideCenter
-	case "PricePerSqmCityCenter":
-		return col.PricePerSqmCityCenter
-	case "PricePerSqmOutsideCenter":
-		return col.PricePerSqmOutsideCenter
-	case "AvgNetSalary":
-		return col.AvgNetSalary
-	default:
-		return 0
+// analyzeMetrics analyzes each metric of models.CostOfLivingMetrics,
+// spreading the metrics over the configured number of workers.
+func (s *CostOfLivingAnalyzerService) analyzeMetrics(colData []models.CostOfLiving) []metricResult {
+	metrics := models.CostOfLivingMetrics
+	results := make([]metricResult, len(metrics))
+	scopes := newCityScopes(colData)
+
+	var im *imputer
+	if s.options.Impute {
+		im = newImputer(colData, s.options.MinPeerCount)
 	}
+
+	workers := s.options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(metrics) {
+		workers = len(metrics)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range next {
+				results[m] = s.analyzeMetric(colData, metrics[m], scopes, im)
+			}
+		}()
+	}
+	for m := range metrics {
+		next <- m
+	}
+	close(next)
+	wg.Wait()
+
+	return results
 }
 
-func (s *CostOfLivingAnalyzerService) getAllMetricValues(colData []CostOfLiving, metric string) []float64 {
-	var values []float64
-	for _, col := range colData {
-		value := s.getMetricValue(col, metric)
+// analyzeMetric ranks every city on one metric. When im is set, cities that
+// do not report the metric are ranked on an imputed value instead.
+func (s *CostOfLivingAnalyzerService) analyzeMetric(colData []models.CostOfLiving, metric string, scopes cityScopes, im *imputer) metricResult {
+	cityValues := make([]float64, len(colData))
+	for i, col := range colData {
+		cityValues[i] = col.MetricValue(metric)
+	}
+
+	distribution := newMetricDistribution(cityValues)
+	result := metricResult{percentiles: make([]float64, len(colData))}
+	if len(distribution.values) > 0 {
+		result.stats = distribution.stats()
+	}
+	for i, value := range cityValues {
+		result.percentiles[i] = math.NaN()
 		if value > 0 {
-			values = append(values, value)
+			result.percentiles[i] = distribution.percentile(value, s.options.PercentileMethod)
+			continue
+		}
+		if im == nil || len(distribution.values) == 0 {
+			continue
+		}
+		if imputed, ok := im.impute(colData[i], metric); ok {
+			if result.imputed == nil {
+				result.imputed = make(map[int]models.ImputedValue)
+			}
+			result.imputed[i] = imputed
+			result.percentiles[i] = distribution.percentile(imputed.Value, s.options.PercentileMethod)
 		}
 	}
-	return values
-}
 
-func (s *CostOfLivingAnalyzerService) calculatePercentile(values []float64, value float64) float64 {
-	sort.Float64s(values)
-	index := sort.SearchFloat64s(values, value)
-	return float64(index) / float64(len(values)) * 100
+	result.countryPercentiles = s.scopedPercentiles(cityValues, scopes.countries)
+	result.continentPercentiles = s.scopedPercentiles(cityValues, scopes.continents)
+	return result
 }
 
-func (s *CostOfLivingAnalyzerService) calculateStats(values []float64) MetricStats {
-	mean := s.calculateMean(values)
-	return MetricStats{
-		Mean:              mean,
-		Median:            s.calculateMedian(values),
-		Mode:              s.calculateMode(values),
-		StandardDeviation: s.calculateStandardDeviation(values, mean),
+// scopedPercentiles ranks each city's value against the other cities in its
+// group. Groups where fewer than MinPeerCount cities report the metric are
+// not ranked.
+func (s *CostOfLivingAnalyzerService) scopedPercentiles(cityValues []float64, groups [][]int) []float64 {
+	percentiles := make([]float64, len(cityValues))
+	for i := range percentiles {
+		percentiles[i] = math.NaN()
 	}
-}
 
-func (s *CostOfLivingAnalyzerService) calculateMean(values []float64) float64 {
-	sum := 0.0
-	for _, v := range values {
-		sum += v
+	groupValues := make([]float64, 0)
+	for _, group := range groups {
+		groupValues = groupValues[:0]
+		for _, i := range group {
+			groupValues = append(groupValues, cityValues[i])
+		}
+
+		distribution := newMetricDistribution(groupValues)
+		if len(distribution.values) == 0 || len(distribution.values) < s.options.MinPeerCount {
+			continue
+		}
+		for _, i := range group {
+			if cityValues[i] > 0 {
+				percentiles[i] = distribution.percentile(cityValues[i], s.options.PercentileMethod)
+			}
+		}
 	}
-	return sum / float64(len(values))
+	return percentiles
 }
 
-func (s *CostOfLivingAnalyzerService) calculateMedian(values []float64) float64 {
-	sort.Float64s(values)
-	mid := len(values) / 2
-	if len(values)%2 == 0 {
-		return (values[mid-1] + values[mid]) / 2
+// storeRelativeScores writes the stats document of the dataset version and
+// then every city's analytics, each pointing at the stats document, and the
+// snapshots under it.
+func (s *CostOfLivingAnalyzerService) storeRelativeScores(ctx context.Context, client *firestore.Client, analysis CostOfLivingAnalysis) error {
+	version := analysis.Stats.DatasetVersion
+	if version == "" || strings.Contains(version, "/") {
+		return fmt.Errorf("invalid dataset version %q", version)
 	}
-	return values[mid]
-}
 
-func (s *CostOfLivingAnalyzerService) calculateMode(values []float64) float64 {
-	frequencyMap := make(map[float64]int)
-	for _, v := range values {
-		frequencyMap[v]++
-	}
-	mode := 0.0
-	maxFrequency := 0
-	for value, frequency := range frequencyMap {
-		if frequency > maxFrequency {
-			mode = value
-			maxFrequency = frequency
-		}
+	backupRun, err := NewBackupService(client).StartRun(ctx, "analyze-cost-of-living")
+	if err != nil {
+		return err
 	}
-	return mode
-}
 
-func (s *CostOfLivingAnalyzerService) calculateStandardDeviation(values []float64, mean float64) float64 {
-	variance := 0.0
-	for _, v := range values {
-		variance += math.Pow(v-mean, 2)
+	relativeScores := analysis.Cities
+	statsRef := client.Doc(models.GetCostOfLivingStatsPath(version))
+	refs := make([]*firestore.DocumentRef, len(relativeScores))
+	for i, rs := range relativeScores {
+		refs[i] = client.Doc(models.GetCostOfLivingAnalyticsPath(rs.City, rs.Country))
+	}
+	snapshotRefs := make([]*firestore.DocumentRef, len(analysis.Snapshots))
+	for i, col := range analysis.Snapshots {
+		snapshotRefs[i] = client.Doc(models.GetCostOfLivingSnapshotPath(version, col.City, col.Country))
+	}
+	captured := append([]*firestore.DocumentRef{statsRef}, refs...)
+	if err := backupRun.Capture(ctx, append(captured, snapshotRefs...)...); err != nil {
+		return err
 	}
-	variance /= float64(len(values))
-	return math.Sqrt(variance)
-}
 
-func (s *CostOfLivingAnalyzerService) storeRelativeScores(ctx context.Context, client *firestore.Client, relativeScores []CostOfLivingAnalytics) error {
-	for _, rs := range relativeScores {
-		_, err := client.Collection("cost-of-living-analytics").Doc(fmt.Sprintf("%s-%s", utils.NormalizeAndFormat(rs.City), utils.NormalizeAndFormat(rs.Country))).Set(ctx, rs)
-		if err != nil {
+	if _, err := setDocument(ctx, statsRef, analysis.Stats); err != nil {
+		return fmt.Errorf("failed to store metric stats: %v", err)
+	}
+
+	writer := NewBulkWriter(ctx, client, DefaultBulkWriterOptions())
+	for i, rs := range relativeScores {
+		rs.StatsRef = statsRef
+		if err := writer.Set(refs[i], rs); err != nil {
 			return err
 		}
 	}
-	return nil
-}
-
-func (s *CostOfLivingAnalyzerService) getPropertyNames(structType interface{}) []string {
-	v := reflect.TypeOf(structType)
-	var propertyNames []string
-
-	for i := 0; i < v.NumField(); i++ {
-		propertyNames = append(propertyNames, v.Field(i).Name)
+	for i, col := range analysis.Snapshots {
+		if err := writer.Set(snapshotRefs[i], col); err != nil {
+			return err
+		}
 	}
 
-	return propertyNames
+	result := writer.End()
+	for _, failure := range result.Failures {
+		logger.LogErrorWithFields("Failed to store relative scores", logrus.Fields{"Error": failure.Err.Error(), "Path": failure.Path})
+	}
+	if len(result.Failures) > 0 {
+		return fmt.Errorf("%d of %d analytics and snapshot documents failed to store", len(result.Failures), len(relativeScores)+len(snapshotRefs))
+	}
+	return nil
 }
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"wander-wallet-tools/models"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	analyzerStateCollection = "_analyzer_state"
+	analyzerStateDocument   = "cost-of-living"
+
+	// A source change that moves no quantile of any metric by more than this
+	// share of the metric's interquartile range leaves unchanged cities as
+	// they are
+	distributionShiftTolerance = 0.01
+	// Scores within this many percentile points of the stored ones are not
+	// rewritten
+	scoreTolerance = 0.01
+)
+
+// AnalyzerState is what the last successful analyzer run was computed from.
+// Fingerprint covers every source document and the analysis options, and
+// Metrics holds the distributions the cities were ranked against.
+type AnalyzerState struct {
+	Fingerprint        string                        `firestore:"fingerprint"`
+	OptionsFingerprint string                        `firestore:"optionsFingerprint"`
+	DatasetVersion     string                        `firestore:"datasetVersion"`
+	Cities             int                           `firestore:"cities"`
+	Metrics            map[string]models.MetricStats `firestore:"metrics"`
+	UpdatedAt          time.Time                     `firestore:"updatedAt"`
+}
+
+// sourceHash fingerprints the values of a cost-of-living document.
+func sourceHash(col models.CostOfLiving) string {
+	data, _ := json.Marshal(col)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// datasetFingerprint combines the source hashes of every city, in a stable
+// order, with the options fingerprint.
+func datasetFingerprint(colData []models.CostOfLiving, optionsFingerprint string) string {
+	hashes := make([]string, len(colData))
+	for i, col := range colData {
+		hashes[i] = col.City + "\x00" + col.Country + "\x00" + sourceHash(col)
+	}
+	sort.Strings(hashes)
+
+	h := sha256.New()
+	for _, hash := range hashes {
+		h.Write([]byte(hash))
+		h.Write([]byte{'\n'})
+	}
+	h.Write([]byte(optionsFingerprint))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// optionsFingerprint covers every option that changes the analysis output.
+// Workers only changes how fast it runs and the dataset version only names
+// the stats document, so both are left out.
+func (s *CostOfLivingAnalyzerService) optionsFingerprint() string {
+	options := s.options
+	options.Workers = 0
+	options.DatasetVersion = ""
+	data, _ := json.Marshal(options)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// resolveDatasetVersion fills in the dataset version of the run when the
+// options leave it empty: the version of the previous run, or today's date on
+// the first run. It reports whether the options name a version other than the
+// previous run's.
+func (s *CostOfLivingAnalyzerService) resolveDatasetVersion(state *AnalyzerState) bool {
+	if s.options.DatasetVersion != "" {
+		return state != nil && state.DatasetVersion != s.options.DatasetVersion
+	}
+	if state != nil && state.DatasetVersion != "" {
+		s.options.DatasetVersion = state.DatasetVersion
+	} else {
+		s.options.DatasetVersion = time.Now().UTC().Format(datasetVersionLayout)
+	}
+	return false
+}
+
+func (s *CostOfLivingAnalyzerService) stateRef() *firestore.DocumentRef {
+	return s.firestoreClient.Collection(analyzerStateCollection).Doc(analyzerStateDocument)
+}
+
+// loadState returns nil when the analyzer has not run before.
+func (s *CostOfLivingAnalyzerService) loadState(ctx context.Context) (*AnalyzerState, error) {
+	doc, err := getDocument(ctx, s.stateRef())
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get analyzer state: %v", err)
+	}
+
+	var state AnalyzerState
+	if err := doc.DataTo(&state); err != nil {
+		return nil, fmt.Errorf("failed to parse analyzer state: %v", err)
+	}
+	return &state, nil
+}
+
+func (s *CostOfLivingAnalyzerService) saveState(ctx context.Context, state AnalyzerState) error {
+	state.UpdatedAt = time.Now()
+	if _, err := setDocument(ctx, s.stateRef(), state); err != nil {
+		return fmt.Errorf("failed to save analyzer state: %v", err)
+	}
+	return nil
+}
+
+// distributionsShifted reports whether any quantile of any metric moved by
+// more than the tolerance, or a metric gained or lost its distribution.
+func distributionsShifted(previous, current map[string]models.MetricStats) bool {
+	if len(previous) != len(current) {
+		return true
+	}
+	for metric, stats := range current {
+		old, ok := previous[metric]
+		if !ok {
+			return true
+		}
+
+		scale := math.Max(old.IQR, math.Abs(old.Median)*distributionShiftTolerance)
+		if scale == 0 {
+			scale = 1
+		}
+		for _, pair := range [][2]float64{
+			{old.P10, stats.P10}, {old.P25, stats.P25}, {old.Median, stats.Median},
+			{old.P75, stats.P75}, {old.P90, stats.P90},
+		} {
+			if math.Abs(pair[1]-pair[0])/scale > distributionShiftTolerance {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scoresMoved reports whether any score differs from the stored analytics by
+// more than the tolerance.
+func scoresMoved(stored, current models.CostOfLivingAnalytics) bool {
+	if stored.Scores.MaxDifference(current.Scores) > scoreTolerance {
+		return true
+	}
+	for profile, score := range current.OverallByProfile {
+		if math.Abs(stored.OverallByProfile[profile]-score) > scoreTolerance {
+			return true
+		}
+	}
+	for metric, score := range current.CountryScores {
+		if math.Abs(stored.CountryScores[metric]-score) > scoreTolerance {
+			return true
+		}
+	}
+	for metric, score := range current.ContinentScores {
+		if math.Abs(stored.ContinentScores[metric]-score) > scoreTolerance {
+			return true
+		}
+	}
+	if stored.PriceTier != current.PriceTier || (stored.Cluster == nil) != (current.Cluster == nil) ||
+		(current.Cluster != nil && (stored.Cluster.Id != current.Cluster.Id || stored.Cluster.Profile != current.Cluster.Profile)) {
+		return true
+	}
+	if len(stored.SimilarCities) != len(current.SimilarCities) {
+		return true
+	}
+	for i, similar := range current.SimilarCities {
+		if stored.SimilarCities[i].City != similar.City || stored.SimilarCities[i].Country != similar.Country {
+			return true
+		}
+	}
+	return len(stored.OverallByProfile) != len(current.OverallByProfile) ||
+		len(stored.CountryScores) != len(current.CountryScores) ||
+		len(stored.ContinentScores) != len(current.ContinentScores)
+}
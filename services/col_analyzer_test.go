@@ -0,0 +1,157 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"wander-wallet-tools/models"
+)
+
+// syntheticCostOfLivingData generates cities with log-normally distributed
+// prices, whole-unit ties and about one missing value in ten.
+func syntheticCostOfLivingData(cities int, rng *rand.Rand) []models.CostOfLiving {
+	colData := make([]models.CostOfLiving, cities)
+	for i := range colData {
+		col := &colData[i]
+		col.City = fmt.Sprintf("City %d", i)
+		col.Country = fmt.Sprintf("Country %d", i%200)
+		col.DataQuality = rng.Intn(2)
+
+		v := reflect.ValueOf(col).Elem()
+		for f := 0; f < v.NumField(); f++ {
+			if v.Field(f).Kind() != reflect.Float64 || rng.Intn(10) == 0 {
+				continue
+			}
+			v.Field(f).SetFloat(float64(int(rng.ExpFloat64()*100)) + 1)
+		}
+	}
+	return colData
+}
+
+// naivePercentile ranks value by comparing it with every reported value.
+func naivePercentile(values []float64, value float64, method PercentileMethod) float64 {
+	below, equal, reported := 0, 0, 0
+	for _, v := range values {
+		if v <= 0 {
+			continue
+		}
+		reported++
+		if v < value {
+			below++
+		} else if v == value {
+			equal++
+		}
+	}
+	return method.rank(below, equal, reported)
+}
+
+func TestPercentileMethodsRankTies(t *testing.T) {
+	distribution := newMetricDistribution([]float64{30, 0, 20, 10, 20})
+
+	tests := []struct {
+		method   PercentileMethod
+		value    float64
+		expected float64
+	}{
+		{PercentileLowerRank, 10, 0},
+		{PercentileLowerRank, 20, 25},
+		{PercentileMidRank, 10, 12.5},
+		{PercentileMidRank, 20, 50},
+		{PercentileLinear, 10, 0},
+		{PercentileLinear, 20, 50},
+		{PercentileLinear, 30, 100},
+		{PercentileECDF, 20, 75},
+		{PercentileECDF, 30, 100},
+		// Values not in the distribution, as imputed ones usually are
+		{PercentileLowerRank, 5, 0},
+		{PercentileLowerRank, 15, 25},
+		{PercentileLowerRank, 40, 100},
+		{PercentileMidRank, 5, 0},
+		{PercentileMidRank, 15, 25},
+		{PercentileMidRank, 40, 100},
+		{PercentileLinear, 5, 0},
+		{PercentileLinear, 15, 50.0 / 3},
+		{PercentileLinear, 40, 100},
+		{PercentileECDF, 5, 0},
+		{PercentileECDF, 15, 25},
+		{PercentileECDF, 40, 100},
+	}
+	for _, test := range tests {
+		if got := distribution.percentile(test.value, test.method); math.Abs(got-test.expected) > 1e-9 {
+			t.Errorf("%s percentile of %v = %v, expected %v", test.method, test.value, got, test.expected)
+		}
+	}
+}
+
+func TestAnalyzePercentilesMatchNaiveRanking(t *testing.T) {
+	colData := syntheticCostOfLivingData(300, rand.New(rand.NewSource(1)))
+
+	for _, method := range percentileMethods {
+		t.Run(string(method), func(t *testing.T) {
+			options := DefaultCostOfLivingAnalyzerOptions()
+			options.PercentileMethod = method
+			options.MaxClusters = 0
+			analysis := NewCostOfLivingAnalyzerService(nil, options).AnalyzeData(colData)
+
+			for _, metric := range models.CostOfLivingMetrics {
+				values := make([]float64, len(colData))
+				for i, col := range colData {
+					values[i] = col.MetricValue(metric)
+				}
+				for i, value := range values {
+					if value <= 0 {
+						continue
+					}
+					expected := naivePercentile(values, value, method)
+					if got := analysis.Cities[i].Scores.Get(metric); got != expected {
+						t.Fatalf("%s of %s scored %v, expected %v", metric, colData[i].City, got, expected)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkAnalyze times the ranking of AnalyzeData on synthetic datasets up
+// to 50k cities, sequentially and with a worker per CPU. Clustering and
+// similar cities are benchmarked separately so they do not hide the ranking;
+// similar cities compare every pair of cities, so only on smaller datasets.
+func BenchmarkAnalyze(b *testing.B) {
+	defaults := DefaultCostOfLivingAnalyzerOptions()
+	defaults.MaxClusters = 0
+	defaults.SimilarCities = 0
+	sequential := defaults
+	sequential.Workers = 1
+	clustering := defaults
+	clustering.MaxClusters = 8
+	similar := defaults
+	similar.SimilarCities = 10
+
+	benchmarks := []struct {
+		name    string
+		cities  int
+		options CostOfLivingAnalyzerOptions
+	}{
+		{"cities=1000", 1000, defaults},
+		{"cities=10000", 10000, defaults},
+		{"cities=50000", 50000, defaults},
+		{"cities=50000/sequential", 50000, sequential},
+		{"cities=10000/clustering", 10000, clustering},
+		{"cities=50000/clustering", 50000, clustering},
+		{"cities=1000/similar-cities", 1000, similar},
+		{"cities=5000/similar-cities", 5000, similar},
+	}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			colData := syntheticCostOfLivingData(benchmark.cities, rand.New(rand.NewSource(1)))
+			analyzer := NewCostOfLivingAnalyzerService(nil, benchmark.options)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				analyzer.AnalyzeData(colData)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+
+	"wander-wallet-tools/models"
+)
+
+const DefaultBudgetBasketFile = "data/cost_of_living/budget_basket.csv"
+
+// BasketItem is one line of the monthly budget basket: how many units of a
+// metric's price a person spends on per month at each budget level.
+type BasketItem struct {
+	Item        string
+	Metric      string
+	Lean        float64
+	Moderate    float64
+	Comfortable float64
+}
+
+// LoadBudgetBasket reads the basket from a CSV file with the columns item,
+// metric, lean, moderate and comfortable.
+func LoadBudgetBasket(filename string) ([]BasketItem, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open budget basket: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read budget basket: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]bool)
+	for _, metric := range models.CostOfLivingMetrics {
+		known[metric] = true
+	}
+
+	var basket []BasketItem
+	for line, record := range records[1:] { // Skip header
+		if len(record) != 5 {
+			return nil, fmt.Errorf("budget basket line %d: expected 5 columns, got %d", line+2, len(record))
+		}
+		if !known[record[1]] {
+			return nil, fmt.Errorf("budget basket line %d: unknown metric %s", line+2, record[1])
+		}
+
+		item := BasketItem{Item: record[0], Metric: record[1]}
+		for i, quantity := range []*float64{&item.Lean, &item.Moderate, &item.Comfortable} {
+			*quantity, err = strconv.ParseFloat(record[2+i], 64)
+			if err != nil || *quantity < 0 {
+				return nil, fmt.Errorf("budget basket line %d: invalid quantity %s", line+2, record[2+i])
+			}
+		}
+		basket = append(basket, item)
+	}
+	return basket, nil
+}
+
+// priceBasket prices every budget level of the basket against the city.
+// Items the city does not report are listed as missing and left out of the
+// total, so a total with missing items is an underestimate.
+func priceBasket(basket []BasketItem, col models.CostOfLiving) *models.CostOfLivingBudget {
+	budget := &models.CostOfLivingBudget{}
+	levels := []struct {
+		tier     *models.BudgetTier
+		quantity func(BasketItem) float64
+	}{
+		{&budget.Lean, func(item BasketItem) float64 { return item.Lean }},
+		{&budget.Moderate, func(item BasketItem) float64 { return item.Moderate }},
+		{&budget.Comfortable, func(item BasketItem) float64 { return item.Comfortable }},
+	}
+
+	for _, level := range levels {
+		for _, item := range basket {
+			quantity := level.quantity(item)
+			if quantity == 0 {
+				continue
+			}
+
+			unitPrice := col.MetricValue(item.Metric)
+			if unitPrice <= 0 {
+				level.tier.MissingItems = append(level.tier.MissingItems, item.Item)
+				continue
+			}
+			line := models.BudgetLine{
+				Item:      item.Item,
+				Metric:    item.Metric,
+				Quantity:  quantity,
+				UnitPrice: unitPrice,
+				Cost:      quantity * unitPrice,
+			}
+			level.tier.Lines = append(level.tier.Lines, line)
+			level.tier.Total += line.Cost
+		}
+	}
+	return budget
+}
+
+// basketRatio is the cost of the moderate budget basket at col's prices over
+// its cost at base's prices, using only the items priced in both, and the
+// number of those items.
+func basketRatio(basket []BasketItem, col, base models.CostOfLiving) (float64, int) {
+	var cost, baseCost float64
+	items := 0
+	for _, item := range basket {
+		price, basePrice := col.MetricValue(item.Metric), base.MetricValue(item.Metric)
+		if item.Moderate == 0 || price <= 0 || basePrice <= 0 {
+			continue
+		}
+		cost += item.Moderate * price
+		baseCost += item.Moderate * basePrice
+		items++
+	}
+	if items == 0 {
+		return 0, 0
+	}
+	return cost / baseCost, items
+}
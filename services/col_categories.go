@@ -0,0 +1,87 @@
+package services
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+
+	"wander-wallet-tools/models"
+)
+
+const DefaultMetricCategoriesFile = "data/cost_of_living/metric_categories.csv"
+
+// MetricCategory groups related metrics, such as rents and purchase prices
+// under housing, so a city can be scored per area of spending.
+type MetricCategory struct {
+	Name    string
+	Metrics []string
+}
+
+// LoadMetricCategories reads categories from a CSV file with the columns
+// metric and category. Categories keep the order they first appear in.
+func LoadMetricCategories(filename string) ([]MetricCategory, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metric categories: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metric categories: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]bool)
+	for _, metric := range models.CostOfLivingMetrics {
+		known[metric] = true
+	}
+
+	var categories []MetricCategory
+	index := make(map[string]int)
+	for line, record := range records[1:] { // Skip header
+		if len(record) != 2 {
+			return nil, fmt.Errorf("metric categories line %d: expected 2 columns, got %d", line+2, len(record))
+		}
+		metric, name := record[0], record[1]
+		if !known[metric] {
+			return nil, fmt.Errorf("metric categories line %d: unknown metric %s", line+2, metric)
+		}
+
+		i, ok := index[name]
+		if !ok {
+			i = len(categories)
+			index[name] = i
+			categories = append(categories, MetricCategory{Name: name})
+		}
+		categories[i].Metrics = append(categories[i].Metrics, metric)
+	}
+	return categories, nil
+}
+
+// score averages the city's percentiles over the category's metrics it is
+// scored on, counting the reported and the imputed ones apart. ok is false
+// when it is scored on none of them.
+func (c MetricCategory) score(scores models.Scores, scored map[string]bool, imputed map[string]models.ImputedValue) (models.CategoryScore, bool) {
+	categoryScore := models.CategoryScore{TotalMetrics: len(c.Metrics)}
+	var total float64
+	for _, metric := range c.Metrics {
+		if !scored[metric] {
+			continue
+		}
+		total += scores.Get(metric)
+		if _, ok := imputed[metric]; ok {
+			categoryScore.ImputedMetrics++
+		} else {
+			categoryScore.ContributingMetrics++
+		}
+	}
+	count := categoryScore.ContributingMetrics + categoryScore.ImputedMetrics
+	if count == 0 {
+		return categoryScore, false
+	}
+	categoryScore.Score = total / float64(count)
+	return categoryScore, true
+}
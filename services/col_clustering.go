@@ -0,0 +1,340 @@
+package services
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"unicode"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// clusterMinCount is the fewest clusters tried, one per price tier, as
+	// the silhouette score of continuous price data favours 2 clusters
+	clusterMinCount         = 4
+	clusterMaxIterations    = 100
+	clusterSilhouetteCities = 1000 // cities sampled to score each cluster count
+	// clusterProfileMargin is how far, in percentile points, a category must
+	// sit from the cluster's price level to be named in its profile
+	clusterProfileMargin = 5
+)
+
+// clusterMetrics are the prices cities are clustered on: everyday spending
+// and rent, as in the cost-of-living plus rent index.
+var clusterMetrics = costOfLivingPlusRentIndexMetrics
+
+// clusterCities groups cities with similar prices by k-means over their
+// percentiles on clusterMetrics, trying 4 to MaxClusters clusters and keeping
+// the count with the best silhouette score. Cities scored on fewer than half
+// of the metrics are not clustered; the others have their missing metrics
+// filled in with their mean percentile. Clusters are numbered from cheapest
+// to most expensive. The result is indexed like colData, with nil for cities
+// that were not clustered.
+func (s *CostOfLivingAnalyzerService) clusterCities(colData []models.CostOfLiving, results []metricResult) []*models.CostCluster {
+	clusters := make([]*models.CostCluster, len(colData))
+	if s.options.MaxClusters < clusterMinCount {
+		return clusters
+	}
+
+	var columns []int
+	for m, metric := range models.CostOfLivingMetrics {
+		for _, clusterMetric := range clusterMetrics {
+			if metric == clusterMetric {
+				columns = append(columns, m)
+			}
+		}
+	}
+
+	var points [][]float64
+	var cities []int
+	for i := range colData {
+		point := make([]float64, len(columns))
+		var total float64
+		var count int
+		for c, m := range columns {
+			point[c] = results[m].percentiles[i]
+			if !math.IsNaN(point[c]) {
+				total += point[c]
+				count++
+			}
+		}
+		if count*2 < len(columns) {
+			continue
+		}
+		for c := range point {
+			if math.IsNaN(point[c]) {
+				point[c] = total / float64(count)
+			}
+		}
+		points = append(points, point)
+		cities = append(cities, i)
+	}
+	if len(points) <= s.options.MaxClusters {
+		return clusters
+	}
+
+	random := rand.New(rand.NewSource(1))
+	sample := random.Perm(len(points))
+	if len(sample) > clusterSilhouetteCities {
+		sample = sample[:clusterSilhouetteCities]
+	}
+
+	var bestCentroids [][]float64
+	var bestAssignment []int
+	bestSilhouette := math.Inf(-1)
+	for k := clusterMinCount; k <= s.options.MaxClusters; k++ {
+		centroids, assignment := kMeans(points, k, random)
+		score := silhouette(points, assignment, k, sample)
+		if score > bestSilhouette {
+			bestCentroids, bestAssignment, bestSilhouette = centroids, assignment, score
+		}
+	}
+
+	// Number the clusters by price level so the same grouping keeps its
+	// numbers between runs
+	k := len(bestCentroids)
+	levels := make([]float64, k)
+	for c, centroid := range bestCentroids {
+		levels[c] = mean(centroid)
+	}
+	order := make([]int, k)
+	for c := range order {
+		order[c] = c
+	}
+	sort.Slice(order, func(a, b int) bool { return levels[order[a]] < levels[order[b]] })
+
+	labels := make([]*models.CostCluster, k)
+	for id, c := range order {
+		labels[c] = &models.CostCluster{
+			Id:       id,
+			Clusters: k,
+			Level:    levels[c],
+			Profile:  s.clusterProfile(clusterMetricNames(columns), bestCentroids[c], levels[c]),
+		}
+	}
+	for p, i := range cities {
+		clusters[i] = labels[bestAssignment[p]]
+	}
+
+	logger.LogInfoWithFields("Clustered cities by cost", logrus.Fields{
+		"Cities":     len(points),
+		"Clusters":   k,
+		"Silhouette": bestSilhouette,
+	})
+	return clusters
+}
+
+// priceTier spreads the clusters, cheapest first, over the tiers $ to $$$$.
+func priceTier(cluster models.CostCluster) string {
+	return strings.Repeat("$", 1+cluster.Id*4/cluster.Clusters)
+}
+
+// clusterProfile names the categories that are cheapest and most expensive
+// relative to the cluster's price level, such as "cheap housing, expensive
+// dining out". Only the metrics clustered on count towards a category.
+// Without categories, the metrics clustered on are compared one by one.
+func (s *CostOfLivingAnalyzerService) clusterProfile(metrics []string, centroid []float64, level float64) string {
+	position := make(map[string]int, len(metrics))
+	for c, metric := range metrics {
+		position[metric] = c
+	}
+
+	categories := s.options.Categories
+	if len(categories) == 0 {
+		for _, metric := range metrics {
+			categories = append(categories, MetricCategory{Name: metric, Metrics: []string{metric}})
+		}
+	}
+
+	cheapest, expensive := "", ""
+	lowest, highest := -float64(clusterProfileMargin), float64(clusterProfileMargin)
+	for _, category := range categories {
+		var total float64
+		var count int
+		for _, metric := range category.Metrics {
+			if c, ok := position[metric]; ok {
+				total += centroid[c]
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		deviation := total/float64(count) - level
+		if deviation < lowest {
+			cheapest, lowest = category.Name, deviation
+		}
+		if deviation > highest {
+			expensive, highest = category.Name, deviation
+		}
+	}
+
+	var parts []string
+	if cheapest != "" {
+		parts = append(parts, "cheap "+categoryWords(cheapest))
+	}
+	if expensive != "" {
+		parts = append(parts, "expensive "+categoryWords(expensive))
+	}
+	if len(parts) == 0 {
+		return "evenly priced"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func clusterMetricNames(columns []int) []string {
+	names := make([]string, len(columns))
+	for c, m := range columns {
+		names[c] = models.CostOfLivingMetrics[m]
+	}
+	return names
+}
+
+// categoryWords turns a category name such as "diningOut" into "dining out".
+func categoryWords(name string) string {
+	var words strings.Builder
+	for _, r := range name {
+		if unicode.IsUpper(r) {
+			words.WriteRune(' ')
+		}
+		words.WriteRune(unicode.ToLower(r))
+	}
+	return words.String()
+}
+
+// kMeans runs Lloyd's algorithm from a k-means++ seeding and returns the
+// centroids and the cluster of every point.
+func kMeans(points [][]float64, k int, random *rand.Rand) ([][]float64, []int) {
+	centroids := make([][]float64, 0, k)
+	centroids = append(centroids, append([]float64{}, points[random.Intn(len(points))]...))
+
+	// k-means++: pick each further centroid with probability proportional
+	// to the squared distance to the nearest centroid so far
+	nearest := make([]float64, len(points))
+	for i, point := range points {
+		nearest[i] = squaredDistance(point, centroids[0])
+	}
+	for len(centroids) < k {
+		var total float64
+		for _, d := range nearest {
+			total += d
+		}
+		target := random.Float64() * total
+		next := len(points) - 1
+		for i, d := range nearest {
+			target -= d
+			if target <= 0 {
+				next = i
+				break
+			}
+		}
+		centroid := append([]float64{}, points[next]...)
+		centroids = append(centroids, centroid)
+		for i, point := range points {
+			if d := squaredDistance(point, centroid); d < nearest[i] {
+				nearest[i] = d
+			}
+		}
+	}
+
+	assignment := make([]int, len(points))
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	for iteration := 0; iteration < clusterMaxIterations; iteration++ {
+		changed := false
+		for i, point := range points {
+			best, bestDistance := 0, math.Inf(1)
+			for c, centroid := range centroids {
+				if d := squaredDistance(point, centroid); d < bestDistance {
+					best, bestDistance = c, d
+				}
+			}
+			if assignment[i] != best {
+				assignment[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		counts := make([]int, k)
+		for c := range centroids {
+			centroids[c] = make([]float64, len(points[0]))
+		}
+		for i, point := range points {
+			c := assignment[i]
+			counts[c]++
+			for d, value := range point {
+				centroids[c][d] += value
+			}
+		}
+		for c := range centroids {
+			if counts[c] == 0 {
+				// Restart an empty cluster on a random point
+				copy(centroids[c], points[random.Intn(len(points))])
+				continue
+			}
+			for d := range centroids[c] {
+				centroids[c][d] /= float64(counts[c])
+			}
+		}
+	}
+	return centroids, assignment
+}
+
+// silhouette returns the mean silhouette score of the sampled points,
+// measured against the other sampled points.
+func silhouette(points [][]float64, assignment []int, k int, sample []int) float64 {
+	var total float64
+	for _, i := range sample {
+		distances := make([]float64, k)
+		counts := make([]int, k)
+		for _, j := range sample {
+			if i == j {
+				continue
+			}
+			distances[assignment[j]] += math.Sqrt(squaredDistance(points[i], points[j]))
+			counts[assignment[j]]++
+		}
+
+		own := assignment[i]
+		if counts[own] == 0 {
+			continue // a single point cluster scores 0
+		}
+		a := distances[own] / float64(counts[own])
+		b := math.Inf(1)
+		for c := range distances {
+			if c != own && counts[c] > 0 && distances[c]/float64(counts[c]) < b {
+				b = distances[c] / float64(counts[c])
+			}
+		}
+		if math.IsInf(b, 1) {
+			continue
+		}
+		total += (b - a) / math.Max(a, b)
+	}
+	return total / float64(len(sample))
+}
+
+func squaredDistance(a, b []float64) float64 {
+	var sum float64
+	for d := range a {
+		sum += (a[d] - b[d]) * (a[d] - b[d])
+	}
+	return sum
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
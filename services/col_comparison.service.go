@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/models"
+
+	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MetricComparison compares one metric of city B against city A. The
+// differences are B minus A, PercentDifference relative to A. A value is NaN
+// when its city does not report the metric, and so are the differences.
+type MetricComparison struct {
+	Metric            string
+	ValueA            float64
+	ValueB            float64
+	Difference        float64
+	PercentDifference float64
+}
+
+// CategoryComparison compares one category. ScoreA and ScoreB are the
+// cities' category sub-scores, NaN when a city has no analytics or no score
+// for the category, and Difference is NaN unless both have one.
+// PercentDifference is how much more (or less) the category's prices are in
+// B, over the Metrics both cities report, and NaN when there are none.
+type CategoryComparison struct {
+	Category          string
+	ScoreA            float64
+	ScoreB            float64
+	Difference        float64
+	PercentDifference float64
+	Metrics           int
+}
+
+type CityComparison struct {
+	CityA      models.CostOfLiving
+	CityB      models.CostOfLiving
+	Metrics    []MetricComparison
+	Categories []CategoryComparison
+	// PriceLevel is city B's prices, including rent, relative to city A's,
+	// where 100 means the same
+	PriceLevel float64
+	// BudgetLevel is the cost of the moderate monthly budget basket in city B
+	// relative to city A, priced on the BasketItems both cities report; NaN
+	// when there are none
+	BudgetLevel float64
+	BasketItems int
+	// Salary in city A and the salary needed in city B for the same
+	// standard of living, scaled by BudgetLevel and NaN with it
+	Salary           float64
+	EquivalentSalary float64
+}
+
+type CostOfLivingComparisonService struct {
+	firestoreClient *firestore.Client
+}
+
+func NewCostOfLivingComparisonService(firestoreClient *firestore.Client) *CostOfLivingComparisonService {
+	return &CostOfLivingComparisonService{
+		firestoreClient: firestoreClient,
+	}
+}
+
+// CompareCities loads both cities' cost-of-living and analytics documents,
+// compares them and writes city_comparison.csv. Missing analytics only leave
+// the category scores empty.
+func (s *CostOfLivingComparisonService) CompareCities(ctx context.Context, cityA, countryA, cityB, countryB string, salary float64, basket []BasketItem, categories []MetricCategory) (*CityComparison, error) {
+	colA, analyticsA, err := s.loadCity(ctx, cityA, countryA)
+	if err != nil {
+		return nil, err
+	}
+	colB, analyticsB, err := s.loadCity(ctx, cityB, countryB)
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := CompareCostOfLiving(*colA, *colB, analyticsA, analyticsB, salary, basket, categories)
+
+	if err := s.writeComparisonCSV("city_comparison.csv", comparison); err != nil {
+		return comparison, err
+	}
+
+	logger.LogInfoWithFields("Compared cities", logrus.Fields{
+		"CityA":            fmt.Sprintf("%s, %s", colA.City, colA.Country),
+		"CityB":            fmt.Sprintf("%s, %s", colB.City, colB.Country),
+		"PriceLevel":       fmt.Sprintf("%.1f", comparison.PriceLevel),
+		"BudgetLevel":      fmt.Sprintf("%.1f", comparison.BudgetLevel),
+		"BasketItems":      comparison.BasketItems,
+		"Salary":           salary,
+		"EquivalentSalary": fmt.Sprintf("%.2f", comparison.EquivalentSalary),
+	})
+	return comparison, nil
+}
+
+func (s *CostOfLivingComparisonService) loadCity(ctx context.Context, city, country string) (*models.CostOfLiving, *models.CostOfLivingAnalytics, error) {
+	doc, err := getDocument(ctx, s.firestoreClient.Doc(models.GetCostOfLivingPath(city, country)))
+	if status.Code(err) == codes.NotFound {
+		return nil, nil, fmt.Errorf("no cost of living data for %s, %s", city, country)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get cost of living for %s, %s: %v", city, country, err)
+	}
+	var col models.CostOfLiving
+	if err := doc.DataTo(&col); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse cost of living for %s, %s: %v", city, country, err)
+	}
+
+	doc, err = getDocument(ctx, s.firestoreClient.Doc(models.GetCostOfLivingAnalyticsPath(city, country)))
+	if status.Code(err) == codes.NotFound {
+		return &col, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get cost of living analytics for %s, %s: %v", city, country, err)
+	}
+	var analytics models.CostOfLivingAnalytics
+	if err := doc.DataTo(&analytics); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse cost of living analytics for %s, %s: %v", city, country, err)
+	}
+	return &col, &analytics, nil
+}
+
+// CompareCostOfLiving compares city B against city A. The equivalent salary
+// scales salary by the cost of the moderate monthly budget basket in B over
+// its cost in A. Anything that cannot be compared, because a city does not
+// report it, is NaN.
+func CompareCostOfLiving(a, b models.CostOfLiving, analyticsA, analyticsB *models.CostOfLivingAnalytics, salary float64, basket []BasketItem, categories []MetricCategory) *CityComparison {
+	comparison := &CityComparison{
+		CityA:  a,
+		CityB:  b,
+		Salary: salary,
+	}
+
+	for _, metric := range models.CostOfLivingMetrics {
+		valueA, valueB := a.MetricValue(metric), b.MetricValue(metric)
+		if valueA <= 0 && valueB <= 0 {
+			continue
+		}
+		metricComparison := MetricComparison{
+			Metric:            metric,
+			ValueA:            reportedValue(valueA),
+			ValueB:            reportedValue(valueB),
+			Difference:        math.NaN(),
+			PercentDifference: math.NaN(),
+		}
+		if valueA > 0 && valueB > 0 {
+			metricComparison.Difference = valueB - valueA
+			metricComparison.PercentDifference = (valueB - valueA) / valueA * 100
+		}
+		comparison.Metrics = append(comparison.Metrics, metricComparison)
+	}
+
+	for _, category := range categories {
+		categoryComparison := CategoryComparison{
+			Category:          category.Name,
+			ScoreA:            categoryScore(analyticsA, category.Name),
+			ScoreB:            categoryScore(analyticsB, category.Name),
+			PercentDifference: math.NaN(),
+		}
+		categoryComparison.Difference = categoryComparison.ScoreB - categoryComparison.ScoreA
+		if level := priceIndex(b, a, category.Metrics); level > 0 {
+			categoryComparison.PercentDifference = level - 100
+		}
+		for _, metric := range category.Metrics {
+			if a.MetricValue(metric) > 0 && b.MetricValue(metric) > 0 {
+				categoryComparison.Metrics++
+			}
+		}
+		comparison.Categories = append(comparison.Categories, categoryComparison)
+	}
+
+	comparison.PriceLevel = priceIndex(b, a, costOfLivingPlusRentIndexMetrics)
+	comparison.BudgetLevel, comparison.EquivalentSalary = math.NaN(), math.NaN()
+	ratio, items := basketRatio(basket, b, a)
+	if items > 0 {
+		comparison.BudgetLevel = ratio * 100
+		comparison.BasketItems = items
+		comparison.EquivalentSalary = salary * ratio
+	}
+	return comparison
+}
+
+// reportedValue returns NaN for a metric value the city does not report.
+func reportedValue(value float64) float64 {
+	if value <= 0 {
+		return math.NaN()
+	}
+	return value
+}
+
+// categoryScore returns NaN when the city has no analytics or no score for
+// the category.
+func categoryScore(analytics *models.CostOfLivingAnalytics, category string) float64 {
+	if analytics == nil {
+		return math.NaN()
+	}
+	score, ok := analytics.Categories[category]
+	if !ok {
+		return math.NaN()
+	}
+	return score.Score
+}
+
+func (s *CostOfLivingComparisonService) writeComparisonCSV(filename string, comparison *CityComparison) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	headers := []string{"Kind", "Name", comparison.CityA.City, comparison.CityB.City, "Difference", "PercentDifference"}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("error writing CSV headers: %v", err)
+	}
+
+	rows := [][]string{}
+	for _, m := range comparison.Metrics {
+		rows = append(rows, []string{"metric", m.Metric, formatFloat(m.ValueA), formatFloat(m.ValueB), formatFloat(m.Difference), formatFloat(m.PercentDifference)})
+	}
+	for _, c := range comparison.Categories {
+		rows = append(rows, []string{"category", c.Category, formatFloat(c.ScoreA), formatFloat(c.ScoreB), formatFloat(c.Difference), formatFloat(c.PercentDifference)})
+	}
+	rows = append(rows, []string{"salary", "equivalentSalary", formatFloat(comparison.Salary), formatFloat(comparison.EquivalentSalary), formatFloat(comparison.EquivalentSalary - comparison.Salary), formatFloat(comparison.BudgetLevel - 100)})
+
+	for _, row := range rows {
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("error writing CSV row: %v", err)
+		}
+	}
+	return nil
+}
+
+// formatFloat rounds value to two decimals, leaving NaN, a value that could
+// not be computed, as an empty cell.
+func formatFloat(value float64) string {
+	if math.IsNaN(value) {
+		return ""
+	}
+	return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+}
@@ -28,7 +28,7 @@ func (s *CostOfLivingCleanupService) CleanupCostOfLivingData(ctx context.Context
 	logger.LogInfoLn("Starting cleanup of cost-of-living-staging data")
 
 	// Get all documents from the collection
-	docSnaps, err := s.firestoreClient.Collection("cost-of-travel-staging").Documents(ctx).GetAll()
+	docSnaps, err := queryAllDocuments(ctx, s.firestoreClient.Collection("cost-of-travel-staging").Query)
 	if err != nil {
 		logger.LogErrorLn("Error getting all documents", err)
 		return err
@@ -36,6 +36,12 @@ func (s *CostOfLivingCleanupService) CleanupCostOfLivingData(ctx context.Context
 
 	logger.LogInfoLn(fmt.Sprintf("Retrieved %d documents for processing", len(docSnaps)))
 
+	backupRun, err := NewBackupService(s.firestoreClient).StartRun(ctx, "cleanup-cost-of-living")
+	if err != nil {
+		logger.LogErrorLn("Error starting backup run", err)
+		return err
+	}
+
 	// Process documents in batches
 	batchSize := 500 // Firestore's maximum batch size
 	for i := 0; i < len(docSnaps); i += batchSize {
@@ -44,7 +50,7 @@ func (s *CostOfLivingCleanupService) CleanupCostOfLivingData(ctx context.Context
 			end = len(docSnaps)
 		}
 
-		err := s.processBatch(ctx, docSnaps[i:end])
+		err := s.processBatch(ctx, backupRun, docSnaps[i:end])
 		if err != nil {
 			logger.LogErrorLn(fmt.Sprintf("Error processing batch %d to %d", i, end), err)
 			return err
@@ -53,13 +59,14 @@ func (s *CostOfLivingCleanupService) CleanupCostOfLivingData(ctx context.Context
 		logger.LogInfoLn(fmt.Sprintf("Processed batch %d to %d", i, end))
 	}
 
-	logger.LogInfoLn("Completed cleanup of cost-of-living-staging data")
+	logger.LogInfoLn(fmt.Sprintf("Completed cleanup of cost-of-living-staging data. Backup run: %s", backupRun.RunId))
 	return nil
 }
 
-func (s *CostOfLivingCleanupService) processBatch(ctx context.Context, docSnaps []*firestore.DocumentSnapshot) error {
+func (s *CostOfLivingCleanupService) processBatch(ctx context.Context, backupRun *BackupRun, docSnaps []*firestore.DocumentSnapshot) error {
 	batch := s.firestoreClient.Batch()
 	changesMade := false
+	var affectedRefs []*firestore.DocumentRef
 
 	for _, doc := range docSnaps {
 		oldID := doc.Ref.ID
@@ -74,6 +81,7 @@ func (s *CostOfLivingCleanupService) processBatch(ctx context.Context, docSnaps
 			batch.Set(newDocRef, doc.Data())
 
 			changesMade = true
+			affectedRefs = append(affectedRefs, doc.Ref, newDocRef)
 
 			logger.LogInfoLn(fmt.Sprintf("Cleaned up document ID: %s -> %s", oldID, newID))
 		}
@@ -81,7 +89,12 @@ func (s *CostOfLivingCleanupService) processBatch(ctx context.Context, docSnaps
 
 	// Only commit if changes were made
 	if changesMade {
-		_, err := batch.Commit(ctx)
+		if err := backupRun.Capture(ctx, affectedRefs...); err != nil {
+			logger.LogErrorLn("Error backing up documents", err)
+			return err
+		}
+
+		err := commitBatch(ctx, batch)
 		if err != nil {
 			logger.LogErrorLn("Error committing batch", err)
 			return err
@@ -168,7 +168,7 @@ func (s *CostOfLivingService) uploadToFirestore(ctx context.Context, data []map[
 			// batch.Set(docRef, item)
 		}
 
-		_, err := batch.Commit(ctx)
+		err := commitBatch(ctx, batch)
 		if err != nil {
 			return fmt.Errorf("failed to commit batch starting at index %d: %v", i, err)
 		}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"math"
+	"sort"
+
+	"wander-wallet-tools/models"
+)
+
+const (
+	ImputedCountryMedian   = "country-median"
+	ImputedContinentMedian = "continent-median"
+	ImputedRegression      = "regression"
+
+	minRegressionPairs       = 30  // cities reporting both metrics before a regression is fitted
+	minRegressionCorrelation = 0.5 // weakest log-log correlation a predictor may have
+)
+
+// metricRegression predicts a metric from a correlated one with a straight
+// line fitted to the logs of both: log(y) = intercept + slope × log(x).
+type metricRegression struct {
+	predictor string
+	intercept float64
+	slope     float64
+}
+
+// imputer fills in metrics a city does not report. It tries the median of
+// the city's country, then of its continent, then a regression on the most
+// correlated metric the city does report. Medians need at least minPeers
+// reporting cities. Everything is fitted on reported values only.
+type imputer struct {
+	countryMedians   map[string]map[string]float64 // metric, country
+	continentMedians map[string]map[string]float64 // metric, continent code
+	regressions      map[string][]metricRegression // metric, best predictor first
+}
+
+func newImputer(colData []models.CostOfLiving, minPeers int) *imputer {
+	im := &imputer{
+		countryMedians:   make(map[string]map[string]float64),
+		continentMedians: make(map[string]map[string]float64),
+		regressions:      make(map[string][]metricRegression),
+	}
+
+	logValues := make(map[string][]float64)
+	for _, metric := range models.CostOfLivingMetrics {
+		byCountry := make(map[string][]float64)
+		byContinent := make(map[string][]float64)
+		logs := make([]float64, len(colData))
+		for i, col := range colData {
+			value := col.MetricValue(metric)
+			if value <= 0 {
+				logs[i] = math.NaN()
+				continue
+			}
+			logs[i] = math.Log(value)
+			byCountry[col.Country] = append(byCountry[col.Country], value)
+			if code := models.GetCountryContinentCode(col.Country); code != "" {
+				byContinent[code] = append(byContinent[code], value)
+			}
+		}
+		im.countryMedians[metric] = groupMedians(byCountry, minPeers)
+		im.continentMedians[metric] = groupMedians(byContinent, minPeers)
+		logValues[metric] = logs
+	}
+
+	for _, metric := range models.CostOfLivingMetrics {
+		var candidates []metricRegression
+		var correlations []float64
+		for _, predictor := range models.CostOfLivingMetrics {
+			if predictor == metric {
+				continue
+			}
+			regression, correlation, ok := fitLogRegression(logValues[predictor], logValues[metric])
+			if !ok || math.Abs(correlation) < minRegressionCorrelation {
+				continue
+			}
+			regression.predictor = predictor
+			candidates = append(candidates, regression)
+			correlations = append(correlations, math.Abs(correlation))
+		}
+
+		order := make([]int, len(candidates))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool { return correlations[order[a]] > correlations[order[b]] })
+		for _, i := range order {
+			im.regressions[metric] = append(im.regressions[metric], candidates[i])
+		}
+	}
+	return im
+}
+
+// impute estimates a metric the city does not report. ok is false when no
+// method applies.
+func (im *imputer) impute(col models.CostOfLiving, metric string) (models.ImputedValue, bool) {
+	if median, ok := im.countryMedians[metric][col.Country]; ok {
+		return models.ImputedValue{Value: median, Method: ImputedCountryMedian}, true
+	}
+	if median, ok := im.continentMedians[metric][models.GetCountryContinentCode(col.Country)]; ok {
+		return models.ImputedValue{Value: median, Method: ImputedContinentMedian}, true
+	}
+	for _, regression := range im.regressions[metric] {
+		if x := col.MetricValue(regression.predictor); x > 0 {
+			return models.ImputedValue{
+				Value:     math.Exp(regression.intercept + regression.slope*math.Log(x)),
+				Method:    ImputedRegression,
+				Predictor: regression.predictor,
+			}, true
+		}
+	}
+	return models.ImputedValue{}, false
+}
+
+func groupMedians(groups map[string][]float64, minPeers int) map[string]float64 {
+	medians := make(map[string]float64)
+	for key, values := range groups {
+		if len(values) == 0 || len(values) < minPeers {
+			continue
+		}
+		sort.Float64s(values)
+		medians[key] = sortedQuantile(values, 0.5)
+	}
+	return medians
+}
+
+// fitLogRegression fits y on x by least squares over the cities reporting
+// both (non-NaN logs) and returns the Pearson correlation of the pairs.
+func fitLogRegression(x, y []float64) (metricRegression, float64, bool) {
+	var n, sumX, sumY, sumXX, sumYY, sumXY float64
+	for i := range x {
+		if math.IsNaN(x[i]) || math.IsNaN(y[i]) {
+			continue
+		}
+		n++
+		sumX += x[i]
+		sumY += y[i]
+		sumXX += x[i] * x[i]
+		sumYY += y[i] * y[i]
+		sumXY += x[i] * y[i]
+	}
+	if n < minRegressionPairs {
+		return metricRegression{}, 0, false
+	}
+
+	covariance := sumXY - sumX*sumY/n
+	varianceX := sumXX - sumX*sumX/n
+	varianceY := sumYY - sumY*sumY/n
+	if varianceX <= 0 || varianceY <= 0 {
+		return metricRegression{}, 0, false
+	}
+
+	slope := covariance / varianceX
+	regression := metricRegression{
+		slope:     slope,
+		intercept: (sumY - slope*sumX) / n,
+	}
+	return regression, covariance / math.Sqrt(varianceX*varianceY), true
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"math"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/models"
+	"wander-wallet-tools/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	indexApartmentSqm   = 90  // apartment size used for the price-to-income ratio
+	indexMortgageMonths = 240 // 20 year fixed-rate mortgage, as mortgageRate is quoted
+)
+
+// costOfLivingIndexMetrics are the everyday prices behind the cost-of-living
+// index. Rent, property prices and new cars are left out as they are not
+// recurring consumer spending.
+var costOfLivingIndexMetrics = []string{
+	"mealInexpensiveRestaurant", "mealFor2MidRange", "comboMealMcdonalds", "domesticBeerRestaurant",
+	"importedBeerRestaurant", "cappuccinoRestaurant", "sodaRestaurant", "waterRestaurant",
+	"milk1L", "breadLoaf", "rice1Kg", "eggs12Pack", "localCheese1Kg", "chickenFillet1Kg",
+	"beefRound1Kg", "apples1Kg", "banana1Kg", "oranges1Kg", "tomato1Kg", "potato1Kg", "onion1Kg",
+	"lettuceHead", "water1_5LMarket", "wineMidRange", "domesticBeerMarket", "importedBeerMarket",
+	"cigarettesPack", "ticketOneWay", "monthlyPass", "taxiStart", "taxi1Km", "taxiWaiting1Hour",
+	"gasoline1L", "utilities85sqmApartment", "mobileTariff1Min", "internetUnlimited",
+	"fitnessClubMonthly", "tennisCourtHourly", "cinemaTicket", "preschoolMonthly",
+	"intlPrimarySchoolYearly", "jeans", "summerDress", "nikeShoes", "leatherShoes",
+}
+
+var rentIndexMetrics = []string{
+	"apt1BedCityCenter", "apt1BedOutsideCenter", "apt3BedCityCenter", "apt3BedOutsideCenter",
+}
+
+var costOfLivingPlusRentIndexMetrics = append(append([]string{}, costOfLivingIndexMetrics...), rentIndexMetrics...)
+
+// computeIndices relates each city's prices to its salaries and to the base
+// city, whose indices are 100. The result is indexed like colData, with nil
+// for every city when the base city is not in the data.
+func (s *CostOfLivingAnalyzerService) computeIndices(colData []models.CostOfLiving) []*models.CostOfLivingIndices {
+	indices := make([]*models.CostOfLivingIndices, len(colData))
+
+	baseId := cityId(s.options.IndexBaseCity, s.options.IndexBaseCountry)
+	var base *models.CostOfLiving
+	for i := range colData {
+		if cityId(colData[i].City, colData[i].Country) == baseId {
+			base = &colData[i]
+			break
+		}
+	}
+	if base == nil {
+		logger.LogInfoWithFields("Index base city not found, skipping indices", logrus.Fields{
+			"City":    s.options.IndexBaseCity,
+			"Country": s.options.IndexBaseCountry,
+		})
+		return indices
+	}
+
+	baseRentToIncome := rentToIncome(*base)
+	basePriceToIncome := priceToIncome(*base)
+	baseMortgageShare := mortgageShareOfIncome(*base)
+
+	for i, col := range colData {
+		index := &models.CostOfLivingIndices{
+			BaseCity:    base.City,
+			BaseCountry: base.Country,
+		}
+		index.CostOfLiving = priceIndex(col, *base, costOfLivingIndexMetrics)
+		index.Rent = priceIndex(col, *base, rentIndexMetrics)
+		index.CostOfLivingPlusRent = priceIndex(col, *base, costOfLivingPlusRentIndexMetrics)
+
+		// Local purchasing power is what the average salary buys relative to
+		// what the base city's average salary buys there
+		if index.CostOfLiving > 0 && col.AvgNetSalary > 0 && base.AvgNetSalary > 0 {
+			index.PurchasingPower = col.AvgNetSalary / base.AvgNetSalary / (index.CostOfLiving / 100) * 100
+		}
+
+		index.RentToIncome = rentToIncome(col)
+		index.PriceToIncome = priceToIncome(col)
+		index.MortgageShareOfIncome = mortgageShareOfIncome(col)
+		index.RentToIncomeIndex = relativeIndex(index.RentToIncome, baseRentToIncome)
+		index.PriceToIncomeIndex = relativeIndex(index.PriceToIncome, basePriceToIncome)
+		index.MortgageShareOfIncomeIndex = relativeIndex(index.MortgageShareOfIncome, baseMortgageShare)
+
+		indices[i] = index
+	}
+	return indices
+}
+
+// priceIndex is the geometric mean of the city's prices relative to the base
+// city's, over the metrics both report, scaled so the base city is 100.
+func priceIndex(col, base models.CostOfLiving, metrics []string) float64 {
+	var logSum float64
+	var count int
+	for _, metric := range metrics {
+		price := col.MetricValue(metric)
+		basePrice := base.MetricValue(metric)
+		if price > 0 && basePrice > 0 {
+			logSum += math.Log(price / basePrice)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return math.Exp(logSum/float64(count)) * 100
+}
+
+// rentToIncome is the rent of a one-bedroom apartment in the city centre as a
+// percentage of the average monthly net salary.
+func rentToIncome(col models.CostOfLiving) float64 {
+	if col.Apt1BedCityCenter <= 0 || col.AvgNetSalary <= 0 {
+		return 0
+	}
+	return col.Apt1BedCityCenter / col.AvgNetSalary * 100
+}
+
+// priceToIncome is the number of years of average net salary needed to buy a
+// 90 m² apartment in the city centre.
+func priceToIncome(col models.CostOfLiving) float64 {
+	if col.PricePerSqmCityCenter <= 0 || col.AvgNetSalary <= 0 {
+		return 0
+	}
+	return col.PricePerSqmCityCenter * indexApartmentSqm / (col.AvgNetSalary * 12)
+}
+
+// mortgageShareOfIncome is the monthly payment of a 20 year fixed-rate
+// mortgage over the full price of a 90 m² city centre apartment, as a
+// percentage of the average monthly net salary.
+func mortgageShareOfIncome(col models.CostOfLiving) float64 {
+	if col.PricePerSqmCityCenter <= 0 || col.AvgNetSalary <= 0 || col.MortgageRate <= 0 {
+		return 0
+	}
+	principal := col.PricePerSqmCityCenter * indexApartmentSqm
+	monthlyRate := col.MortgageRate / 100 / 12
+	payment := principal * monthlyRate / (1 - math.Pow(1+monthlyRate, -indexMortgageMonths))
+	return payment / col.AvgNetSalary * 100
+}
+
+func relativeIndex(value, baseValue float64) float64 {
+	if value <= 0 || baseValue <= 0 {
+		return 0
+	}
+	return value / baseValue * 100
+}
+
+func cityId(city, country string) string {
+	return utils.NormalizeAndFormat(city) + "-" + utils.NormalizeAndFormat(country)
+}
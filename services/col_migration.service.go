@@ -2,15 +2,34 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"wander-wallet-tools/logger"
 
 	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/api/iterator"
 )
 
+const (
+	colMigrationSourceCollection      = "cost-of-travel-staging"
+	colMigrationDestinationCollection = "cost-of-living"
+	colMigrationCheckpointFile        = "col_migration_checkpoint.json"
+)
+
+// MigrationCheckpoint records the last committed batch of a migration. Source
+// documents are read in document ID order, so LastDocID is also the cursor a
+// resumed run starts after.
+type MigrationCheckpoint struct {
+	LastDocID     string    `json:"lastDocId"`
+	TotalMigrated int       `json:"totalMigrated"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
 type CostOfLivingMigrationService struct {
 	firestoreClient *firestore.Client
 }
@@ -21,20 +40,83 @@ func NewCostOfLivingMigrationService(firestoreClient *firestore.Client) *CostOfL
 	}
 }
 
-func (s *CostOfLivingMigrationService) MigrateCostOfLivingData(ctx context.Context) error {
+func (s *CostOfLivingMigrationService) MigrateCostOfLivingData(ctx context.Context, resume bool, writerOptions BulkWriterOptions) error {
 	logger.LogInfoLn("Starting migration of cost-of-living data")
 
-	sourceCollection := s.firestoreClient.Collection("cost-of-travel-staging")
-	destinationCollection := s.firestoreClient.Collection("cost-of-living")
+	sourceCollection := s.firestoreClient.Collection(colMigrationSourceCollection)
+	destinationCollection := s.firestoreClient.Collection(colMigrationDestinationCollection)
+
+	checkpoint := &MigrationCheckpoint{}
+	if resume {
+		saved, err := s.loadCheckpoint()
+		if err != nil {
+			logger.LogErrorLn("Error loading migration checkpoint", err)
+			return err
+		}
+		if saved != nil {
+			checkpoint = saved
+			logger.LogInfoLn(fmt.Sprintf("Resuming migration after document %s. Previously migrated: %d", checkpoint.LastDocID, checkpoint.TotalMigrated))
+		} else {
+			logger.LogInfoLn("No migration checkpoint found, starting from the first document")
+		}
+	}
 
-	// Get all documents from the source collection
-	iter := sourceCollection.Documents(ctx)
+	backupRun, err := NewBackupService(s.firestoreClient).StartRun(ctx, "migrate-cost-of-living")
+	if err != nil {
+		logger.LogErrorLn("Error starting backup run", err)
+		return err
+	}
+
+	// Get all documents from the source collection in a stable order so the
+	// last committed document ID can be used as a cursor
+	query := sourceCollection.OrderBy(firestore.DocumentID, firestore.Asc)
+	if checkpoint.LastDocID != "" {
+		query = query.StartAfter(checkpoint.LastDocID)
+	}
+	iter := query.Documents(ctx)
 	defer iter.Stop()
 
-	batch := s.firestoreClient.Batch()
-	batchSize := 0
-	maxBatchSize := 500 // Firestore limit
-	totalMigrated := 0
+	writer := NewBulkWriter(ctx, s.firestoreClient, writerOptions)
+	defer writer.End()
+
+	chunkRefs := []*firestore.DocumentRef{}
+	chunkData := []map[string]interface{}{}
+	chunkSize := 500 // documents between checkpoints
+	totalMigrated := checkpoint.TotalMigrated
+	lastDocID := checkpoint.LastDocID
+
+	// writeChunk writes the buffered documents in parallel and only advances
+	// the checkpoint when every one of them succeeded, so a resumed run
+	// repeats at most the chunk that failed
+	writeChunk := func() error {
+		if err := backupRun.Capture(ctx, chunkRefs...); err != nil {
+			logger.LogErrorLn("Error backing up documents", err)
+			return err
+		}
+		for i, ref := range chunkRefs {
+			if err := writer.Set(ref, chunkData[i]); err != nil {
+				return fmt.Errorf("failed to enqueue write for %s: %v", ref.ID, err)
+			}
+		}
+
+		result := writer.Flush()
+		if len(result.Failures) > 0 {
+			for _, failure := range result.Failures {
+				logger.LogErrorWithFields("Failed to migrate document", logrus.Fields{"Error": failure.Err.Error(), "Path": failure.Path})
+			}
+			return fmt.Errorf("%d of %d documents in batch failed to migrate", len(result.Failures), len(chunkRefs))
+		}
+
+		totalMigrated += result.Succeeded
+		if err := s.saveCheckpoint(lastDocID, totalMigrated); err != nil {
+			return err
+		}
+		logger.LogInfoLn(fmt.Sprintf("Migrated batch of %d documents. Total migrated: %d", result.Succeeded, totalMigrated))
+
+		chunkRefs = []*firestore.DocumentRef{}
+		chunkData = []map[string]interface{}{}
+		return nil
+	}
 
 	for {
 		doc, err := iter.Next()
@@ -47,49 +129,67 @@ func (s *CostOfLivingMigrationService) MigrateCostOfLivingData(ctx context.Conte
 		}
 
 		// Create a new document in the destination collection with the same ID and data
-		newDocRef := destinationCollection.Doc(doc.Ref.ID)
-		batch.Set(newDocRef, doc.Data())
-
-		batchSize++
-		totalMigrated++
+		chunkRefs = append(chunkRefs, destinationCollection.Doc(doc.Ref.ID))
+		chunkData = append(chunkData, doc.Data())
+		lastDocID = doc.Ref.ID
 
-		// If we've reached the batch limit, commit and start a new batch
-		if batchSize == maxBatchSize {
-			if err := s.commitBatchWithRetry(ctx, batch); err != nil {
+		if len(chunkRefs) == chunkSize {
+			if err := writeChunk(); err != nil {
 				return err
 			}
-			batch = s.firestoreClient.Batch()
-			batchSize = 0
-			logger.LogInfoLn(fmt.Sprintf("Migrated batch of %d documents. Total migrated: %d", maxBatchSize, totalMigrated))
 		}
 	}
 
-	// Commit any remaining documents
-	if batchSize > 0 {
-		if err := s.commitBatchWithRetry(ctx, batch); err != nil {
+	// Write any remaining documents
+	if len(chunkRefs) > 0 {
+		if err := writeChunk(); err != nil {
 			return err
 		}
-		logger.LogInfoLn(fmt.Sprintf("Migrated final batch of %d documents. Total migrated: %d", batchSize, totalMigrated))
 	}
 
-	logger.LogInfoLn(fmt.Sprintf("Completed migration of cost-of-living data. Total documents migrated: %d", totalMigrated))
+	// The migration finished, so the next run should start from the beginning
+	if err := os.Remove(colMigrationCheckpointFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.LogErrorLn("Error removing migration checkpoint", err)
+	}
+
+	logger.LogInfoLn(fmt.Sprintf("Completed migration of cost-of-living data. Total documents migrated: %d. Backup run: %s", totalMigrated, backupRun.RunId))
 	return nil
 }
 
-func (s *CostOfLivingMigrationService) commitBatchWithRetry(ctx context.Context, batch *firestore.WriteBatch) error {
-	maxRetries := 3
-	var lastErr error
+func (s *CostOfLivingMigrationService) loadCheckpoint() (*MigrationCheckpoint, error) {
+	data, err := os.ReadFile(colMigrationCheckpointFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint file: %v", err)
+	}
 
-	for i := 0; i < maxRetries; i++ {
-		_, err := batch.Commit(ctx)
-		if err == nil {
-			return nil
-		}
-		lastErr = err
-		logger.LogErrorLn(fmt.Sprintf("Error committing batch (attempt %d/%d): %v", i+1, maxRetries, err), err)
-		time.Sleep(time.Second * time.Duration(i+1)) // Simple exponential backoff
+	var checkpoint MigrationCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint file: %v", err)
 	}
+	return &checkpoint, nil
+}
 
-	logger.LogErrorLn(fmt.Sprintf("Failed to commit batch after %d attempts", maxRetries), lastErr)
-	return lastErr
+func (s *CostOfLivingMigrationService) saveCheckpoint(lastDocID string, totalMigrated int) error {
+	checkpoint := MigrationCheckpoint{
+		LastDocID:     lastDocID,
+		TotalMigrated: totalMigrated,
+		UpdatedAt:     time.Now(),
+	}
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %v", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated checkpoint
+	tmpFile := colMigrationCheckpointFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint file: %v", err)
+	}
+	if err := os.Rename(tmpFile, colMigrationCheckpointFile); err != nil {
+		return fmt.Errorf("failed to write checkpoint file: %v", err)
+	}
+	return nil
 }
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"wander-wallet-tools/logger"
+
+	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+const (
+	DivergenceMissing    = "missing"
+	DivergenceExtra      = "extra"
+	DivergenceMismatched = "mismatched"
+)
+
+// ErrMigrationDiverged is returned by VerifyCostOfLivingMigration when the
+// destination collection does not match the source.
+var ErrMigrationDiverged = errors.New("migrated collection diverges from source")
+
+type FieldDiff struct {
+	Field            string
+	SourceValue      interface{}
+	DestinationValue interface{}
+}
+
+type DocumentDivergence struct {
+	DocID  string
+	Status string
+	Diffs  []FieldDiff
+}
+
+type MigrationVerificationReport struct {
+	SourceCount      int
+	DestinationCount int
+	MatchedCount     int
+	Divergences      []DocumentDivergence
+}
+
+func (r *MigrationVerificationReport) Diverged() bool {
+	return len(r.Divergences) > 0
+}
+
+// VerifyCostOfLivingMigration streams the source and destination collections
+// in document ID order, compares their document sets and content hashes, and
+// writes every missing, extra and mismatched document to a CSV report.
+func (s *CostOfLivingMigrationService) VerifyCostOfLivingMigration(ctx context.Context) (*MigrationVerificationReport, error) {
+	logger.LogInfoLn("Starting verification of cost-of-living migration")
+
+	sourceIter := s.firestoreClient.Collection(colMigrationSourceCollection).OrderBy(firestore.DocumentID, firestore.Asc).Documents(ctx)
+	defer sourceIter.Stop()
+	destinationIter := s.firestoreClient.Collection(colMigrationDestinationCollection).OrderBy(firestore.DocumentID, firestore.Asc).Documents(ctx)
+	defer destinationIter.Stop()
+
+	report := &MigrationVerificationReport{}
+
+	sourceDoc, err := nextDocument(sourceIter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source collection: %v", err)
+	}
+	destinationDoc, err := nextDocument(destinationIter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read destination collection: %v", err)
+	}
+
+	for sourceDoc != nil || destinationDoc != nil {
+		switch {
+		case destinationDoc == nil || (sourceDoc != nil && sourceDoc.Ref.ID < destinationDoc.Ref.ID):
+			report.SourceCount++
+			report.Divergences = append(report.Divergences, DocumentDivergence{DocID: sourceDoc.Ref.ID, Status: DivergenceMissing})
+			if sourceDoc, err = nextDocument(sourceIter); err != nil {
+				return nil, fmt.Errorf("failed to read source collection: %v", err)
+			}
+		case sourceDoc == nil || destinationDoc.Ref.ID < sourceDoc.Ref.ID:
+			report.DestinationCount++
+			report.Divergences = append(report.Divergences, DocumentDivergence{DocID: destinationDoc.Ref.ID, Status: DivergenceExtra})
+			if destinationDoc, err = nextDocument(destinationIter); err != nil {
+				return nil, fmt.Errorf("failed to read destination collection: %v", err)
+			}
+		default:
+			report.SourceCount++
+			report.DestinationCount++
+			sourceData := sourceDoc.Data()
+			destinationData := destinationDoc.Data()
+			if hashDocumentData(sourceData) == hashDocumentData(destinationData) {
+				report.MatchedCount++
+			} else {
+				report.Divergences = append(report.Divergences, DocumentDivergence{
+					DocID:  sourceDoc.Ref.ID,
+					Status: DivergenceMismatched,
+					Diffs:  diffDocumentData("", sourceData, destinationData),
+				})
+			}
+			if sourceDoc, err = nextDocument(sourceIter); err != nil {
+				return nil, fmt.Errorf("failed to read source collection: %v", err)
+			}
+			if destinationDoc, err = nextDocument(destinationIter); err != nil {
+				return nil, fmt.Errorf("failed to read destination collection: %v", err)
+			}
+		}
+	}
+
+	if err := s.writeVerificationReportCSV("col_migration_verification_report.csv", report); err != nil {
+		return report, err
+	}
+
+	logger.LogInfoWithFields("Completed verification of cost-of-living migration", logrus.Fields{
+		"SourceCount":      report.SourceCount,
+		"DestinationCount": report.DestinationCount,
+		"MatchedCount":     report.MatchedCount,
+		"DivergentCount":   len(report.Divergences),
+	})
+
+	if report.Diverged() {
+		return report, ErrMigrationDiverged
+	}
+	return report, nil
+}
+
+func (s *CostOfLivingMigrationService) writeVerificationReportCSV(filename string, report *MigrationVerificationReport) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	headers := []string{"Document ID", "Status", "Field", "Source Value", "Destination Value"}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("error writing CSV headers: %v", err)
+	}
+
+	for _, divergence := range report.Divergences {
+		if len(divergence.Diffs) == 0 {
+			if err := writer.Write([]string{divergence.DocID, divergence.Status, "", "", ""}); err != nil {
+				return fmt.Errorf("error writing CSV row: %v", err)
+			}
+			continue
+		}
+		for _, diff := range divergence.Diffs {
+			row := []string{
+				divergence.DocID,
+				divergence.Status,
+				diff.Field,
+				formatFieldValue(diff.SourceValue),
+				formatFieldValue(diff.DestinationValue),
+			}
+			if err := writer.Write(row); err != nil {
+				return fmt.Errorf("error writing CSV row: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func nextDocument(iter *firestore.DocumentIterator) (*firestore.DocumentSnapshot, error) {
+	doc, err := iter.Next()
+	if err == iterator.Done {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// hashDocumentData returns a SHA-256 of the document fields that does not
+// depend on map iteration order.
+func hashDocumentData(data map[string]interface{}) string {
+	h := sha256.New()
+	hashFieldValue(h, data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func hashFieldValue(h hash.Hash, value interface{}) {
+	writeString := func(s string) {
+		binary.Write(h, binary.BigEndian, uint64(len(s)))
+		h.Write([]byte(s))
+	}
+
+	switch v := value.(type) {
+	case nil:
+		h.Write([]byte{'n'})
+	case bool:
+		h.Write([]byte{'b'})
+		binary.Write(h, binary.BigEndian, v)
+	case int64:
+		h.Write([]byte{'i'})
+		binary.Write(h, binary.BigEndian, v)
+	case float64:
+		h.Write([]byte{'f'})
+		binary.Write(h, binary.BigEndian, math.Float64bits(v))
+	case string:
+		h.Write([]byte{'s'})
+		writeString(v)
+	case []byte:
+		h.Write([]byte{'y'})
+		writeString(string(v))
+	case time.Time:
+		h.Write([]byte{'t'})
+		binary.Write(h, binary.BigEndian, v.UnixNano())
+	case *latlng.LatLng:
+		h.Write([]byte{'g'})
+		binary.Write(h, binary.BigEndian, math.Float64bits(v.GetLatitude()))
+		binary.Write(h, binary.BigEndian, math.Float64bits(v.GetLongitude()))
+	case *firestore.DocumentRef:
+		h.Write([]byte{'r'})
+		writeString(v.Path)
+	case []interface{}:
+		h.Write([]byte{'a'})
+		binary.Write(h, binary.BigEndian, uint64(len(v)))
+		for _, element := range v {
+			hashFieldValue(h, element)
+		}
+	case map[string]interface{}:
+		h.Write([]byte{'m'})
+		binary.Write(h, binary.BigEndian, uint64(len(v)))
+		for _, key := range sortedKeys(v) {
+			writeString(key)
+			hashFieldValue(h, v[key])
+		}
+	default:
+		h.Write([]byte{'?'})
+		writeString(fmt.Sprintf("%T:%v", v, v))
+	}
+}
+
+// diffDocumentData returns the dotted field paths that differ between two
+// documents, descending into nested maps.
+func diffDocumentData(prefix string, source, destination map[string]interface{}) []FieldDiff {
+	keys := make(map[string]bool)
+	for key := range source {
+		keys[key] = true
+	}
+	for key := range destination {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var diffs []FieldDiff
+	for _, key := range sorted {
+		field := key
+		if prefix != "" {
+			field = prefix + "." + key
+		}
+
+		sourceValue, inSource := source[key]
+		destinationValue, inDestination := destination[key]
+		sourceMap, sourceIsMap := sourceValue.(map[string]interface{})
+		destinationMap, destinationIsMap := destinationValue.(map[string]interface{})
+
+		switch {
+		case inSource && inDestination && sourceIsMap && destinationIsMap:
+			diffs = append(diffs, diffDocumentData(field, sourceMap, destinationMap)...)
+		case !inSource || !inDestination || !fieldValuesEqual(sourceValue, destinationValue):
+			diffs = append(diffs, FieldDiff{Field: field, SourceValue: sourceValue, DestinationValue: destinationValue})
+		}
+	}
+	return diffs
+}
+
+func fieldValuesEqual(a, b interface{}) bool {
+	refA, aIsRef := a.(*firestore.DocumentRef)
+	refB, bIsRef := b.(*firestore.DocumentRef)
+	if aIsRef && bIsRef {
+		return refA.Path == refB.Path
+	}
+	timeA, aIsTime := a.(time.Time)
+	timeB, bIsTime := b.(time.Time)
+	if aIsTime && bIsTime {
+		return timeA.Equal(timeB)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func formatFieldValue(value interface{}) string {
+	if ref, ok := value.(*firestore.DocumentRef); ok && ref != nil {
+		return ref.Path
+	}
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,504 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/models"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultCostOfLivingDataFile  = "data/cost_of_living/col_data.csv"
+	DefaultColumnMappingFile     = "data/cost_of_living/column_mapping.csv"
+	DefaultOfflineAnalysisPrefix = "offline_analysis"
+)
+
+// overallScore names the overall score among the scores a diff compares.
+const overallScore = "overall"
+
+// AnalysisDiff summarizes how two analyses of the same cities differ. Ranks
+// run from 1, the cheapest city.
+type AnalysisDiff struct {
+	ScoredByOneOnly int // cities only one of the analyses scores
+	TierChanges     int
+	// Scores compares the overall score first, then each metric, category
+	// and weight profile score
+	Scores []ScoreDiff
+}
+
+// ScoreDiff summarizes how one score differs between two analyses, over the
+// cities both give it.
+type ScoreDiff struct {
+	Score             string // overallScore, a metric, "category:<name>" or "profile:<name>"
+	Cities            int
+	MeanAbsoluteDelta float64
+	MaxAbsoluteDelta  float64
+	RankCorrelation   float64 // Spearman's rank correlation of the scores
+}
+
+// LoadCostOfLivingCSV reads the cost-of-living dataset from its CSV export,
+// renaming the columns through the column mapping as the Firestore import
+// does. Missing values are 0, as in Firestore.
+func LoadCostOfLivingCSV(dataFile, mappingFile string) ([]models.CostOfLiving, error) {
+	importer := &CostOfLivingService{}
+	columnMappings, err := importer.readColumnMappings(mappingFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read column mappings: %v", err)
+	}
+	records, err := importer.readCSVData(dataFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV data: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	var colData []models.CostOfLiving
+	for i, item := range importer.processData(records, columnMappings) {
+		var col models.CostOfLiving
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			TagName:          "firestore",
+			WeaklyTypedInput: true, // empty cells decode to 0
+			Result:           &col,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := decoder.Decode(item); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+2, err)
+		}
+		colData = append(colData, col)
+	}
+	return colData, nil
+}
+
+// WriteOfflineAnalysis writes the analysis of colData to <prefix>_scores.csv,
+// with the cities ranked by overall score, <prefix>_stats.csv and, in full,
+// <prefix>.json.
+func WriteOfflineAnalysis(prefix string, colData []models.CostOfLiving, analysis CostOfLivingAnalysis) error {
+	if err := writeOfflineScoresCSV(prefix+"_scores.csv", colData, analysis.Cities); err != nil {
+		return err
+	}
+	if err := writeOfflineStatsCSV(prefix+"_stats.csv", analysis.Stats); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(analysis)
+	if err != nil {
+		return fmt.Errorf("failed to encode analysis: %v", err)
+	}
+	if err := os.WriteFile(prefix+".json", data, 0644); err != nil {
+		return fmt.Errorf("failed to write analysis: %v", err)
+	}
+
+	logger.LogInfoWithFields("Wrote offline analysis", logrus.Fields{
+		"Cities": len(analysis.Cities),
+		"Prefix": prefix,
+	})
+	return nil
+}
+
+// overallRanks ranks the cities by overall score, 1 being the cheapest.
+// Cities without any score are not ranked and get 0. The cities are the
+// analytics of colData, in the same order, which the result keeps.
+func overallRanks(colData []models.CostOfLiving, cities []models.CostOfLivingAnalytics) []int {
+	var indexes []int
+	var overall []float64
+	for i, analytics := range cities {
+		if scored(colData[i], analytics) {
+			indexes = append(indexes, i)
+			overall = append(overall, analytics.Scores.Overall)
+		}
+	}
+
+	ranks := make([]int, len(cities))
+	for n, rank := range valueRanks(overall) {
+		ranks[indexes[n]] = rank
+	}
+	return ranks
+}
+
+// valueRanks ranks values from 1, the smallest, keeping their order.
+func valueRanks(values []float64) []int {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return values[order[a]] < values[order[b]] })
+
+	ranks := make([]int, len(values))
+	for rank, i := range order {
+		ranks[i] = rank + 1
+	}
+	return ranks
+}
+
+// scoredMetric reports whether the city has a score on the metric: it reports
+// the metric or the analysis imputed it. A score of 0 is a real score, that
+// of the cheapest city.
+func scoredMetric(col models.CostOfLiving, analytics models.CostOfLivingAnalytics, metric string) bool {
+	if col.MetricValue(metric) > 0 {
+		return true
+	}
+	_, imputed := analytics.Imputed[metric]
+	return imputed
+}
+
+// scored reports whether the city has a score on any metric.
+func scored(col models.CostOfLiving, analytics models.CostOfLivingAnalytics) bool {
+	for _, metric := range models.CostOfLivingMetrics {
+		if scoredMetric(col, analytics, metric) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatRank(rank int) string {
+	if rank == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", rank)
+}
+
+func writeOfflineScoresCSV(filename string, colData []models.CostOfLiving, cities []models.CostOfLivingAnalytics) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	headers := append([]string{"Rank", "City", "Country", "Overall", "PriceTier"}, models.CostOfLivingMetrics...)
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("error writing CSV headers: %v", err)
+	}
+
+	// Ranked cities first, cheapest first, then the unranked ones
+	ranks := overallRanks(colData, cities)
+	order := make([]int, len(cities))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ra, rb := ranks[order[a]], ranks[order[b]]
+		return ra != 0 && (rb == 0 || ra < rb)
+	})
+	for _, i := range order {
+		analytics := cities[i]
+		// Scores the city does not have are left empty rather than written as 0
+		overall := ""
+		if ranks[i] != 0 {
+			overall = formatFloat(analytics.Scores.Overall)
+		}
+		row := []string{
+			formatRank(ranks[i]),
+			analytics.City,
+			analytics.Country,
+			overall,
+			analytics.PriceTier,
+		}
+		for _, metric := range models.CostOfLivingMetrics {
+			if scoredMetric(colData[i], analytics, metric) {
+				row = append(row, formatFloat(analytics.Scores.Get(metric)))
+			} else {
+				row = append(row, "")
+			}
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("error writing CSV row: %v", err)
+		}
+	}
+	return nil
+}
+
+func writeOfflineStatsCSV(filename string, stats models.CostOfLivingStats) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	headers := []string{"Metric", "Count", "Min", "Max", "Mean", "Median", "P10", "P25", "P75", "P90", "IQR", "StdDev", "MAD"}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("error writing CSV headers: %v", err)
+	}
+
+	for _, metric := range models.CostOfLivingMetrics {
+		s, ok := stats.Metrics[metric]
+		if !ok {
+			continue
+		}
+		row := []string{metric, fmt.Sprintf("%d", s.Count)}
+		for _, value := range []float64{s.Min, s.Max, s.Mean, s.Median, s.P10, s.P25, s.P75, s.P90, s.IQR, s.StdDev, s.MAD} {
+			row = append(row, formatFloat(value))
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("error writing CSV row: %v", err)
+		}
+	}
+	return nil
+}
+
+// DiffAnalyses compares two analyses of colData, such as two scoring
+// configurations, and writes:
+//
+//   - <prefix>_diff.csv: the overall score, rank and price tier of every city
+//     under each side by side, largest change first
+//   - <prefix>_diff_scores.csv: how much each score, overall, per metric, per
+//     category and per weight profile, changed across the cities
+//   - <prefix>_diff_details.csv: every score of a city that changed by more
+//     than scoreTolerance
+func DiffAnalyses(colData []models.CostOfLiving, a, b CostOfLivingAnalysis, prefix string) (AnalysisDiff, error) {
+	ranksA, ranksB := overallRanks(colData, a.Cities), overallRanks(colData, b.Cities)
+	scoresA := make([]map[string]float64, len(colData))
+	scoresB := make([]map[string]float64, len(colData))
+	for i, col := range colData {
+		scoresA[i] = cityScores(col, a.Cities[i])
+		scoresB[i] = cityScores(col, b.Cities[i])
+	}
+
+	var diff AnalysisDiff
+	for i := range colData {
+		if (ranksA[i] == 0) != (ranksB[i] == 0) {
+			diff.ScoredByOneOnly++
+		}
+		if ranksA[i] != 0 && ranksB[i] != 0 && a.Cities[i].PriceTier != b.Cities[i].PriceTier {
+			diff.TierChanges++
+		}
+	}
+	names := scoreNames(scoresA, scoresB)
+	for _, name := range names {
+		diff.Scores = append(diff.Scores, diffScore(name, scoresA, scoresB))
+	}
+
+	if err := writeCityDiffCSV(prefix+"_diff.csv", a.Cities, b.Cities, ranksA, ranksB); err != nil {
+		return diff, err
+	}
+	if err := writeScoreDiffCSV(prefix+"_diff_scores.csv", diff.Scores); err != nil {
+		return diff, err
+	}
+	if err := writeScoreDetailsCSV(prefix+"_diff_details.csv", colData, names, scoresA, scoresB); err != nil {
+		return diff, err
+	}
+
+	fields := logrus.Fields{
+		"ScoredByOneOnly": diff.ScoredByOneOnly,
+		"TierChanges":     diff.TierChanges,
+		"Scores":          len(diff.Scores),
+	}
+	if len(diff.Scores) > 0 && diff.Scores[0].Score == overallScore {
+		overall := diff.Scores[0]
+		fields["Cities"] = overall.Cities
+		fields["MeanAbsoluteDelta"] = overall.MeanAbsoluteDelta
+		fields["MaxAbsoluteDelta"] = overall.MaxAbsoluteDelta
+		fields["RankCorrelation"] = overall.RankCorrelation
+	}
+	logger.LogInfoWithFields("Compared analyzer configurations", fields)
+	return diff, nil
+}
+
+// cityScores returns every score the analysis gives the city, keyed by
+// metric, overallScore, "category:<name>" and "profile:<name>".
+func cityScores(col models.CostOfLiving, analytics models.CostOfLivingAnalytics) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, metric := range models.CostOfLivingMetrics {
+		if scoredMetric(col, analytics, metric) {
+			scores[metric] = analytics.Scores.Get(metric)
+		}
+	}
+	if len(scores) > 0 {
+		scores[overallScore] = analytics.Scores.Overall
+	}
+	for name, category := range analytics.Categories {
+		scores["category:"+name] = category.Score
+	}
+	for name, overall := range analytics.OverallByProfile {
+		scores["profile:"+name] = overall
+	}
+	return scores
+}
+
+// scoreNames lists the scores any city has in either analysis: the overall
+// score, the metrics in their usual order, then categories and profiles by
+// name.
+func scoreNames(scoresA, scoresB []map[string]float64) []string {
+	seen := make(map[string]bool)
+	for _, cities := range [][]map[string]float64{scoresA, scoresB} {
+		for _, scores := range cities {
+			for name := range scores {
+				seen[name] = true
+			}
+		}
+	}
+
+	var names []string
+	for _, name := range append([]string{overallScore}, models.CostOfLivingMetrics...) {
+		if seen[name] {
+			names = append(names, name)
+			delete(seen, name)
+		}
+	}
+	var others []string
+	for name := range seen {
+		others = append(others, name)
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// diffScore compares one score over the cities both analyses give it.
+func diffScore(name string, scoresA, scoresB []map[string]float64) ScoreDiff {
+	diff := ScoreDiff{Score: name}
+	var valuesA, valuesB []float64
+	for i := range scoresA {
+		valueA, okA := scoresA[i][name]
+		valueB, okB := scoresB[i][name]
+		if !okA || !okB {
+			continue
+		}
+		valuesA = append(valuesA, valueA)
+		valuesB = append(valuesB, valueB)
+		delta := math.Abs(valueB - valueA)
+		diff.MeanAbsoluteDelta += delta
+		diff.MaxAbsoluteDelta = math.Max(diff.MaxAbsoluteDelta, delta)
+	}
+
+	diff.Cities = len(valuesA)
+	if diff.Cities > 0 {
+		diff.MeanAbsoluteDelta /= float64(diff.Cities)
+	}
+	// The rank correlation ranks the common cities among themselves
+	if n := float64(diff.Cities); n > 1 {
+		ranksA, ranksB := valueRanks(valuesA), valueRanks(valuesB)
+		var squaredRankDifferences float64
+		for i := range ranksA {
+			d := float64(ranksA[i] - ranksB[i])
+			squaredRankDifferences += d * d
+		}
+		diff.RankCorrelation = 1 - 6*squaredRankDifferences/(n*(n*n-1))
+	}
+	return diff
+}
+
+func writeCityDiffCSV(filename string, citiesA, citiesB []models.CostOfLivingAnalytics, ranksA, ranksB []int) error {
+	order := make([]int, len(citiesA))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(x, y int) bool {
+		dx := math.Abs(citiesB[order[x]].Scores.Overall - citiesA[order[x]].Scores.Overall)
+		dy := math.Abs(citiesB[order[y]].Scores.Overall - citiesA[order[y]].Scores.Overall)
+		return dx > dy
+	})
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	headers := []string{"City", "Country", "OverallA", "OverallB", "Delta", "RankA", "RankB", "RankChange", "PriceTierA", "PriceTierB"}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("error writing CSV headers: %v", err)
+	}
+	for _, i := range order {
+		cityA, cityB := citiesA[i], citiesB[i]
+		rankChange := ""
+		if ranksA[i] != 0 && ranksB[i] != 0 {
+			rankChange = fmt.Sprintf("%d", ranksB[i]-ranksA[i])
+		}
+		row := []string{
+			cityA.City,
+			cityA.Country,
+			formatFloat(cityA.Scores.Overall),
+			formatFloat(cityB.Scores.Overall),
+			formatFloat(cityB.Scores.Overall - cityA.Scores.Overall),
+			formatRank(ranksA[i]),
+			formatRank(ranksB[i]),
+			rankChange,
+			cityA.PriceTier,
+			cityB.PriceTier,
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("error writing CSV row: %v", err)
+		}
+	}
+	return nil
+}
+
+func writeScoreDiffCSV(filename string, scores []ScoreDiff) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	headers := []string{"Score", "Cities", "MeanAbsoluteDelta", "MaxAbsoluteDelta", "RankCorrelation"}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("error writing CSV headers: %v", err)
+	}
+	for _, score := range scores {
+		row := []string{
+			score.Score,
+			fmt.Sprintf("%d", score.Cities),
+			formatFloat(score.MeanAbsoluteDelta),
+			formatFloat(score.MaxAbsoluteDelta),
+			strconv.FormatFloat(score.RankCorrelation, 'f', 4, 64),
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("error writing CSV row: %v", err)
+		}
+	}
+	return nil
+}
+
+func writeScoreDetailsCSV(filename string, colData []models.CostOfLiving, names []string, scoresA, scoresB []map[string]float64) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	headers := []string{"City", "Country", "Score", "A", "B", "Delta"}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("error writing CSV headers: %v", err)
+	}
+	for i, col := range colData {
+		for _, name := range names {
+			valueA, okA := scoresA[i][name]
+			valueB, okB := scoresB[i][name]
+			if !okA || !okB || math.Abs(valueB-valueA) <= scoreTolerance {
+				continue
+			}
+			row := []string{col.City, col.Country, name, formatFloat(valueA), formatFloat(valueB), formatFloat(valueB - valueA)}
+			if err := writer.Write(row); err != nil {
+				return fmt.Errorf("error writing CSV row: %v", err)
+			}
+		}
+	}
+	return nil
+}
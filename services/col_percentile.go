@@ -0,0 +1,64 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// PercentileMethod selects how a value is ranked against a distribution.
+// With n reported values, of which below are smaller than the value and equal
+// are the same:
+//
+//	lower-rank  below / n                       cheapest is 0, most expensive never 100
+//	mid-rank    (below + equal/2) / n           ties share the middle of their block
+//	linear      (below + (equal-1)/2) / (n-1)   cheapest is 0, most expensive is 100
+//	ecdf        (below + equal) / n             share of values at or below, top is 100
+//
+// Every method ranks into 0 to 100, including values outside the
+// distribution, such as imputed ones.
+type PercentileMethod string
+
+const (
+	PercentileLowerRank PercentileMethod = "lower-rank"
+	PercentileMidRank   PercentileMethod = "mid-rank"
+	PercentileLinear    PercentileMethod = "linear"
+	PercentileECDF      PercentileMethod = "ecdf"
+)
+
+var percentileMethods = []PercentileMethod{PercentileLowerRank, PercentileMidRank, PercentileLinear, PercentileECDF}
+
+func ParsePercentileMethod(name string) (PercentileMethod, error) {
+	for _, method := range percentileMethods {
+		if string(method) == name {
+			return method, nil
+		}
+	}
+
+	names := make([]string, len(percentileMethods))
+	for i, method := range percentileMethods {
+		names[i] = string(method)
+	}
+	return "", fmt.Errorf("unknown percentile method %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// rank converts the position of a value in a distribution of n values to a
+// percentile between 0 and 100.
+func (m PercentileMethod) rank(below, equal, n int) float64 {
+	switch m {
+	case PercentileLowerRank:
+		return float64(below) / float64(n) * 100
+	case PercentileLinear:
+		// A single value has nothing to be ranked against, so it sits in the middle
+		if n == 1 {
+			return 50
+		}
+		// A value not in the distribution sits halfway between its neighbours,
+		// or at the end when it is beyond the cheapest or most expensive
+		return math.Min(math.Max((float64(below)+float64(equal-1)/2)/float64(n-1)*100, 0), 100)
+	case PercentileECDF:
+		return float64(below+equal) / float64(n) * 100
+	default:
+		return (float64(below) + float64(equal)/2) / float64(n) * 100
+	}
+}
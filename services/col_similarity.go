@@ -0,0 +1,249 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// similarityMinSharedShare is the share of the weighted metrics two
+	// cities must both be scored on before they are compared, and
+	// similarityMinSharedMetrics the fewest it may come to
+	similarityMinSharedShare   = 0.2
+	similarityMinSharedMetrics = 3
+)
+
+// SimilarityMeasure selects how two cities' percentile vectors are compared.
+//
+//	cosine     cosine of the vectors centred on the 50th percentile, 1 to -1
+//	euclidean  1 minus the weighted RMS percentile difference / 100, 1 to 0
+//
+// Both only use the metrics the two cities are scored on.
+type SimilarityMeasure string
+
+const (
+	SimilarityCosine    SimilarityMeasure = "cosine"
+	SimilarityEuclidean SimilarityMeasure = "euclidean"
+)
+
+var similarityMeasures = []SimilarityMeasure{SimilarityCosine, SimilarityEuclidean}
+
+func ParseSimilarityMeasure(name string) (SimilarityMeasure, error) {
+	for _, measure := range similarityMeasures {
+		if string(measure) == name {
+			return measure, nil
+		}
+	}
+
+	names := make([]string, len(similarityMeasures))
+	for i, measure := range similarityMeasures {
+		names[i] = string(measure)
+	}
+	return "", fmt.Errorf("unknown similarity measure %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// SimilarityWeights returns the metric weights of a weight profile for use as
+// CostOfLivingAnalyzerOptions.SimilarityWeights.
+func SimilarityWeights(profiles []WeightProfile, name string) (map[string]float64, error) {
+	for _, profile := range profiles {
+		if profile.Name == name {
+			weights := make(map[string]float64, len(profile.Weights))
+			for metric, weight := range profile.Weights {
+				weights[metric] = weight.Weight
+			}
+			return weights, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown weight profile %q", name)
+}
+
+// featureVectors holds each city's percentile on the weighted metrics, NaN
+// where the city is not scored on the metric.
+type featureVectors struct {
+	values    [][]float64
+	weights   []float64
+	overall   []float64 // mean percentile over every metric, as in Scores.Overall
+	minShared int       // metrics two cities must share to be compared
+}
+
+func (s *CostOfLivingAnalyzerService) featureVectors(results []metricResult, cities int) featureVectors {
+	var vectors featureVectors
+	var columns []int
+	for m, metric := range models.CostOfLivingMetrics {
+		weight := 1.0
+		if s.options.SimilarityWeights != nil {
+			weight = s.options.SimilarityWeights[metric]
+		}
+		if weight > 0 {
+			columns = append(columns, m)
+			vectors.weights = append(vectors.weights, weight)
+		}
+	}
+
+	vectors.minShared = int(math.Ceil(similarityMinSharedShare * float64(len(columns))))
+	if vectors.minShared < similarityMinSharedMetrics {
+		vectors.minShared = similarityMinSharedMetrics
+	}
+
+	vectors.values = make([][]float64, cities)
+	vectors.overall = make([]float64, cities)
+	for i := 0; i < cities; i++ {
+		vector := make([]float64, len(columns))
+		for c, m := range columns {
+			vector[c] = results[m].percentiles[i]
+		}
+		vectors.values[i] = vector
+
+		var total float64
+		var count int
+		for m := range results {
+			if p := results[m].percentiles[i]; !math.IsNaN(p) {
+				total += p
+				count++
+			}
+		}
+		if count > 0 {
+			vectors.overall[i] = total / float64(count)
+		}
+	}
+	return vectors
+}
+
+// similarity compares two cities, returning ok false when they share too
+// few metrics.
+func (v featureVectors) similarity(a, b int, measure SimilarityMeasure) (float64, bool) {
+	va, vb := v.values[a], v.values[b]
+	var dot, normA, normB, squares, totalWeight float64
+	shared := 0
+	for c, weight := range v.weights {
+		x, y := va[c], vb[c]
+		if math.IsNaN(x) || math.IsNaN(y) {
+			continue
+		}
+		shared++
+		if measure == SimilarityCosine {
+			x, y = x-50, y-50
+			dot += weight * x * y
+			normA += weight * x * x
+			normB += weight * y * y
+		} else {
+			squares += weight * (x - y) * (x - y)
+			totalWeight += weight
+		}
+	}
+	if shared < v.minShared {
+		return 0, false
+	}
+	if measure == SimilarityCosine {
+		if normA == 0 || normB == 0 {
+			return 0, false
+		}
+		return dot / math.Sqrt(normA*normB), true
+	}
+	return 1 - math.Sqrt(squares/totalWeight)/100, true
+}
+
+// similarCities finds the SimilarCities nearest neighbours of every city
+// marked in affected, or of every city when affected is nil, among all
+// cities. Each city is compared with every other, so this is
+// O(cities² × metrics), spread over the configured workers. The result is
+// indexed like colData.
+func (s *CostOfLivingAnalyzerService) similarCities(colData []models.CostOfLiving, results []metricResult, affected []bool) [][]models.SimilarCity {
+	neighbours := make([][]models.SimilarCity, len(colData))
+	k := s.options.SimilarCities
+	if k <= 0 || len(colData) < 2 {
+		return neighbours
+	}
+	vectors := s.featureVectors(results, len(colData))
+
+	workers := s.options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				neighbours[i] = s.nearest(colData, vectors, i, k)
+			}
+		}()
+	}
+	for i := range colData {
+		if affected == nil || affected[i] {
+			next <- i
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	// Sparse weights, such as a profile on a few metrics, can leave most
+	// cities without enough metrics in common to be compared
+	searched, alone := 0, 0
+	for i := range colData {
+		if affected == nil || affected[i] {
+			searched++
+			if len(neighbours[i]) == 0 {
+				alone++
+			}
+		}
+	}
+	if alone*2 > searched {
+		logger.LogErrorWithFields("Most cities have no similar cities", logrus.Fields{
+			"Cities":           searched,
+			"WithoutNeighbour": alone,
+			"WeightedMetrics":  len(vectors.weights),
+			"MinSharedMetrics": vectors.minShared,
+		})
+	}
+
+	return neighbours
+}
+
+func (s *CostOfLivingAnalyzerService) nearest(colData []models.CostOfLiving, vectors featureVectors, i, k int) []models.SimilarCity {
+	type candidate struct {
+		index      int
+		similarity float64
+	}
+
+	// best stays sorted by descending similarity and holds at most k cities
+	best := make([]candidate, 0, k+1)
+	for j := range colData {
+		if j == i {
+			continue
+		}
+		similarity, ok := vectors.similarity(i, j, s.options.SimilarityMeasure)
+		if !ok || (len(best) == k && similarity <= best[k-1].similarity) {
+			continue
+		}
+		at := sort.Search(len(best), func(n int) bool { return best[n].similarity < similarity })
+		best = append(best, candidate{})
+		copy(best[at+1:], best[at:])
+		best[at] = candidate{index: j, similarity: similarity}
+		if len(best) > k {
+			best = best[:k]
+		}
+	}
+
+	similar := make([]models.SimilarCity, len(best))
+	for n, c := range best {
+		similar[n] = models.SimilarCity{
+			City:       colData[c.index].City,
+			Country:    colData[c.index].Country,
+			Similarity: c.similarity,
+			Overall:    vectors.overall[c.index],
+		}
+	}
+	return similar
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	datasetVersionLayout = "2006-01-02"
+	trendMinDays         = 180 // fewest days between a version and its baseline
+	trendTargetDays      = 365
+)
+
+// trendBaseline holds the city snapshots of the earlier dataset version that
+// trends are measured against, keyed by city ID.
+type trendBaseline struct {
+	version string
+	years   float64
+	cities  map[string]models.CostOfLiving
+}
+
+// loadTrendBaseline picks the dataset version closest to a year before the
+// current one, and at least trendMinDays before it, and reads its city
+// snapshots. It returns nil when the versions are not dates or there is no
+// such version.
+func (s *CostOfLivingAnalyzerService) loadTrendBaseline(ctx context.Context) (*trendBaseline, error) {
+	current, err := time.Parse(datasetVersionLayout, s.options.DatasetVersion)
+	if err != nil {
+		logger.LogInfoWithFields("Dataset version is not a date, skipping trends", logrus.Fields{
+			"DatasetVersion": s.options.DatasetVersion,
+		})
+		return nil, nil
+	}
+
+	docs, err := queryAllDocuments(ctx, s.firestoreClient.Collection("cost-of-living-stats").Select())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dataset versions: %v", err)
+	}
+
+	baseline := &trendBaseline{}
+	var baselineDays float64
+	for _, doc := range docs {
+		version, err := time.Parse(datasetVersionLayout, doc.Ref.ID)
+		if err != nil {
+			continue
+		}
+		days := current.Sub(version).Hours() / 24
+		if days < trendMinDays {
+			continue
+		}
+		if baseline.version == "" || math.Abs(days-trendTargetDays) < math.Abs(baselineDays-trendTargetDays) {
+			baseline.version = doc.Ref.ID
+			baselineDays = days
+		}
+	}
+	if baseline.version == "" {
+		logger.LogInfoLn("No earlier dataset version to measure trends against")
+		return nil, nil
+	}
+	baseline.years = baselineDays / 365.25
+
+	snapshots, err := queryAllDocuments(ctx, s.firestoreClient.Doc(models.GetCostOfLivingStatsPath(baseline.version)).Collection("cities").Query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshots of %s: %v", baseline.version, err)
+	}
+	baseline.cities = make(map[string]models.CostOfLiving, len(snapshots))
+	for _, doc := range snapshots {
+		var col models.CostOfLiving
+		if err := doc.DataTo(&col); err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot %s: %v", doc.Ref.ID, err)
+		}
+		baseline.cities[doc.Ref.ID] = col
+	}
+
+	logger.LogInfoWithFields("Measuring trends against an earlier dataset version", logrus.Fields{
+		"BaselineVersion": baseline.version,
+		"Years":           baseline.years,
+		"Cities":          len(baseline.cities),
+	})
+	return baseline, nil
+}
+
+// computeTrend compares the city with its snapshot in the baseline, returning
+// nil when the baseline does not have the city.
+func (s *CostOfLivingAnalyzerService) computeTrend(col models.CostOfLiving, baseline *trendBaseline) *models.CostOfLivingTrend {
+	previous, ok := baseline.cities[cityId(col.City, col.Country)]
+	if !ok {
+		return nil
+	}
+
+	trend := &models.CostOfLivingTrend{
+		BaselineVersion: baseline.version,
+		Years:           baseline.years,
+		MetricChanges:   make(map[string]float64),
+	}
+	for _, metric := range models.CostOfLivingMetrics {
+		now, then := col.MetricValue(metric), previous.MetricValue(metric)
+		if now > 0 && then > 0 {
+			trend.MetricChanges[metric] = annualizedChange(now/then, baseline.years)
+		}
+	}
+
+	ratio, items := s.basketPriceRatio(col, previous)
+	if items > 0 {
+		trend.Inflation = annualizedChange(ratio, baseline.years)
+		trend.BasketItems = items
+	}
+	return trend
+}
+
+// basketPriceRatio is the cost of the moderate budget basket at the city's
+// current prices over its cost at the earlier prices, using the items priced
+// in both. Without a budget basket it is the geometric mean price relative of
+// the cost-of-living index metrics.
+func (s *CostOfLivingAnalyzerService) basketPriceRatio(col, previous models.CostOfLiving) (float64, int) {
+	if len(s.options.BudgetBasket) == 0 {
+		items := 0
+		for _, metric := range costOfLivingIndexMetrics {
+			if col.MetricValue(metric) > 0 && previous.MetricValue(metric) > 0 {
+				items++
+			}
+		}
+		return priceIndex(col, previous, costOfLivingIndexMetrics) / 100, items
+	}
+
+	return basketRatio(s.options.BudgetBasket, col, previous)
+}
+
+// annualizedChange turns a price ratio over the given years into a yearly
+// percentage change.
+func annualizedChange(ratio, years float64) float64 {
+	return (math.Pow(ratio, 1/years) - 1) * 100
+}
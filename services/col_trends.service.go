@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/models"
+	"wander-wallet-tools/utils"
+
+	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
+)
+
+// TrendMover is a city among the fastest rising or falling by inflation.
+type TrendMover struct {
+	Direction       string // "rising" or "falling"
+	City            string
+	Country         string
+	Inflation       float64
+	BaselineVersion string
+	DatasetVersion  string
+	BasketItems     int
+}
+
+type CostOfLivingTrendsService struct {
+	firestoreClient *firestore.Client
+}
+
+func NewCostOfLivingTrendsService(firestoreClient *firestore.Client) *CostOfLivingTrendsService {
+	return &CostOfLivingTrendsService{
+		firestoreClient: firestoreClient,
+	}
+}
+
+// ReportTopMovers lists the top cities with the highest and the lowest
+// inflation in their analytics trend, writing them to
+// cost_of_living_top_movers.csv. destinationsOnly limits the list to cities
+// in top-destinations.
+func (s *CostOfLivingTrendsService) ReportTopMovers(ctx context.Context, top int, destinationsOnly bool) ([]TrendMover, error) {
+	docs, err := queryAllDocuments(ctx, s.firestoreClient.Collection("cost-of-living-analytics").Query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cost of living analytics: %v", err)
+	}
+
+	var destinations map[string]bool
+	if destinationsOnly {
+		destinations, err = s.topDestinationIds(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var trending []models.CostOfLivingAnalytics
+	for _, doc := range docs {
+		var analytics models.CostOfLivingAnalytics
+		if err := doc.DataTo(&analytics); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", doc.Ref.ID, err)
+		}
+		if analytics.Trend == nil || analytics.Trend.BasketItems == 0 {
+			continue
+		}
+		if destinations != nil && !destinations[cityId(analytics.City, analytics.Country)] {
+			continue
+		}
+		trending = append(trending, analytics)
+	}
+	sort.Slice(trending, func(i, j int) bool { return trending[i].Trend.Inflation > trending[j].Trend.Inflation })
+
+	if top > len(trending)/2 {
+		top = len(trending) / 2
+	}
+	var movers []TrendMover
+	for i := 0; i < top; i++ {
+		movers = append(movers, newTrendMover("rising", trending[i]))
+	}
+	for i := 0; i < top; i++ {
+		movers = append(movers, newTrendMover("falling", trending[len(trending)-1-i]))
+	}
+
+	if err := s.writeMoversCSV("cost_of_living_top_movers.csv", movers); err != nil {
+		return movers, err
+	}
+
+	for _, mover := range movers {
+		logger.LogInfoWithFields(fmt.Sprintf("%s: %s, %s", mover.Direction, mover.City, mover.Country), logrus.Fields{
+			"Inflation":       mover.Inflation,
+			"BaselineVersion": mover.BaselineVersion,
+		})
+	}
+	logger.LogInfoWithFields("Completed top movers report", logrus.Fields{
+		"CitiesWithTrends": len(trending),
+		"Movers":           len(movers),
+	})
+	return movers, nil
+}
+
+func newTrendMover(direction string, analytics models.CostOfLivingAnalytics) TrendMover {
+	return TrendMover{
+		Direction:       direction,
+		City:            analytics.City,
+		Country:         analytics.Country,
+		Inflation:       analytics.Trend.Inflation,
+		BaselineVersion: analytics.Trend.BaselineVersion,
+		DatasetVersion:  analytics.DatasetVersion,
+		BasketItems:     analytics.Trend.BasketItems,
+	}
+}
+
+func (s *CostOfLivingTrendsService) topDestinationIds(ctx context.Context) (map[string]bool, error) {
+	docs, err := queryAllDocuments(ctx, s.firestoreClient.Collection("top-destinations").Query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read top destinations: %v", err)
+	}
+
+	ids := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		ids[cityId(utils.GetString(doc.Data(), "city"), utils.GetString(doc.Data(), "country"))] = true
+	}
+	return ids, nil
+}
+
+func (s *CostOfLivingTrendsService) writeMoversCSV(filename string, movers []TrendMover) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	headers := []string{"Direction", "City", "Country", "Inflation", "BaselineVersion", "DatasetVersion", "BasketItems"}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("error writing CSV headers: %v", err)
+	}
+
+	for _, mover := range movers {
+		row := []string{
+			mover.Direction,
+			mover.City,
+			mover.Country,
+			fmt.Sprintf("%.2f", mover.Inflation),
+			mover.BaselineVersion,
+			mover.DatasetVersion,
+			fmt.Sprintf("%d", mover.BasketItems),
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("error writing CSV row: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+
+	"wander-wallet-tools/models"
+)
+
+const DefaultWeightProfilesFile = "data/cost_of_living/weight_profiles.csv"
+
+// MetricWeight is how much one metric counts towards a profile's overall
+// score. When HigherIsBetter is set, a high value makes a city cheaper for
+// the persona (a higher salary, for example), so the percentile is inverted.
+type MetricWeight struct {
+	Weight         float64
+	HigherIsBetter bool
+}
+
+// WeightProfile scores cities for one persona. Metrics without a weight do
+// not count towards the profile.
+type WeightProfile struct {
+	Name    string
+	Weights map[string]MetricWeight
+}
+
+// LoadWeightProfiles reads profiles from a CSV file with the columns profile,
+// metric, weight and higherIsBetter, one row per weighted metric.
+func LoadWeightProfiles(filename string) ([]WeightProfile, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open weight profiles: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read weight profiles: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]bool)
+	for _, metric := range models.CostOfLivingMetrics {
+		known[metric] = true
+	}
+
+	var profiles []WeightProfile
+	index := make(map[string]int)
+	for line, record := range records[1:] { // Skip header
+		if len(record) != 4 {
+			return nil, fmt.Errorf("weight profiles line %d: expected 4 columns, got %d", line+2, len(record))
+		}
+		name, metric := record[0], record[1]
+		if !known[metric] {
+			return nil, fmt.Errorf("weight profiles line %d: unknown metric %s", line+2, metric)
+		}
+		weight, err := strconv.ParseFloat(record[2], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("weight profiles line %d: invalid weight %s", line+2, record[2])
+		}
+		higherIsBetter, err := strconv.ParseBool(record[3])
+		if err != nil {
+			return nil, fmt.Errorf("weight profiles line %d: invalid higherIsBetter %s", line+2, record[3])
+		}
+
+		i, ok := index[name]
+		if !ok {
+			i = len(profiles)
+			index[name] = i
+			profiles = append(profiles, WeightProfile{Name: name, Weights: make(map[string]MetricWeight)})
+		}
+		profiles[i].Weights[metric] = MetricWeight{Weight: weight, HigherIsBetter: higherIsBetter}
+	}
+	return profiles, nil
+}
+
+// overall returns the weighted mean of the city's metric scores, with
+// higher-is-better metrics inverted. ok is false when the city reports none
+// of the profile's weighted metrics.
+func (p WeightProfile) overall(scores models.Scores, reported map[string]bool) (score float64, ok bool) {
+	var weighted, totalWeight float64
+	for metric, weight := range p.Weights {
+		if weight.Weight == 0 || !reported[metric] {
+			continue
+		}
+		value := scores.Get(metric)
+		if weight.HigherIsBetter {
+			value = 100 - value
+		}
+		weighted += weight.Weight * value
+		totalWeight += weight.Weight
+	}
+	if totalWeight == 0 {
+		return 0, false
+	}
+	return weighted / totalWeight, true
+}
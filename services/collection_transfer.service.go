@@ -0,0 +1,382 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/retry"
+
+	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+const (
+	transferBatchSize = 500 // Firestore limit
+	maxExportLineSize = 16 * 1024 * 1024
+)
+
+// ExportedDocument is one NDJSON line of a collection export. Path is relative
+// to the database root so an import can target another project or the
+// emulator, and every field value is wrapped in a typed envelope using the
+// Firestore REST value names (stringValue, referenceValue, mapValue, ...).
+type ExportedDocument struct {
+	Path   string                     `json:"path"`
+	Fields map[string]json.RawMessage `json:"fields"`
+}
+
+type CollectionTransferService struct {
+	firestoreClient *firestore.Client
+}
+
+func NewCollectionTransferService(firestoreClient *firestore.Client) *CollectionTransferService {
+	return &CollectionTransferService{
+		firestoreClient: firestoreClient,
+	}
+}
+
+// ExportCollection writes every document of the collection, including the
+// documents of all nested subcollections, to an NDJSON file.
+func (s *CollectionTransferService) ExportCollection(ctx context.Context, collection string, filename string) error {
+	logger.LogInfoLn(fmt.Sprintf("Starting export of %s to %s", collection, filename))
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	exported, err := s.exportCollection(ctx, s.firestoreClient.Collection(collection), json.NewEncoder(writer))
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write export file: %v", err)
+	}
+
+	logger.LogInfoWithFields("Completed export", logrus.Fields{"Collection": collection, "Documents": exported})
+	return nil
+}
+
+func (s *CollectionTransferService) exportCollection(ctx context.Context, collection *firestore.CollectionRef, encoder *json.Encoder) (int, error) {
+	// DocumentRefs also lists missing parent documents that only hold
+	// subcollections, which Documents would skip
+	var refs []*firestore.DocumentRef
+	err := retry.Do(ctx, "list documents of "+collection.Path, func(ctx context.Context) error {
+		var err error
+		refs, err = collection.DocumentRefs(ctx).GetAll()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list documents of %s: %v", collection.Path, err)
+	}
+
+	exported := 0
+	for i := 0; i < len(refs); i += transferBatchSize {
+		end := i + transferBatchSize
+		if end > len(refs) {
+			end = len(refs)
+		}
+
+		docSnaps, err := getAllDocuments(ctx, s.firestoreClient, refs[i:end])
+		if err != nil {
+			return exported, fmt.Errorf("failed to read documents of %s: %v", collection.Path, err)
+		}
+
+		for _, doc := range docSnaps {
+			if doc.Exists() {
+				fields, err := encodeFields(doc.Data())
+				if err != nil {
+					return exported, fmt.Errorf("failed to encode document %s: %v", doc.Ref.Path, err)
+				}
+				line := ExportedDocument{Path: relativeDocumentPath(doc.Ref), Fields: fields}
+				if err := encoder.Encode(line); err != nil {
+					return exported, fmt.Errorf("failed to write document %s: %v", doc.Ref.Path, err)
+				}
+				exported++
+			}
+
+			var subcollections []*firestore.CollectionRef
+			err := retry.Do(ctx, "list subcollections of "+doc.Ref.Path, func(ctx context.Context) error {
+				var err error
+				subcollections, err = doc.Ref.Collections(ctx).GetAll()
+				return err
+			})
+			if err != nil {
+				return exported, fmt.Errorf("failed to list subcollections of %s: %v", doc.Ref.Path, err)
+			}
+
+			for _, subcollection := range subcollections {
+				count, err := s.exportCollection(ctx, subcollection, encoder)
+				exported += count
+				if err != nil {
+					return exported, err
+				}
+			}
+		}
+	}
+
+	return exported, nil
+}
+
+// ImportDocuments reads an NDJSON export and writes every document back,
+// rebuilding references against the current client's database.
+func (s *CollectionTransferService) ImportDocuments(ctx context.Context, filename string) error {
+	logger.LogInfoLn(fmt.Sprintf("Starting import from %s", filename))
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open import file: %v", err)
+	}
+	defer file.Close()
+
+	backupRun, err := NewBackupService(s.firestoreClient).StartRun(ctx, "import-documents")
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxExportLineSize)
+
+	batch := s.firestoreClient.Batch()
+	batchRefs := []*firestore.DocumentRef{}
+	imported := 0
+
+	commit := func() error {
+		if len(batchRefs) == 0 {
+			return nil
+		}
+		if err := backupRun.Capture(ctx, batchRefs...); err != nil {
+			return err
+		}
+		if err := commitBatch(ctx, batch); err != nil {
+			return fmt.Errorf("failed to commit import batch: %v", err)
+		}
+		imported += len(batchRefs)
+		logger.LogInfoLn(fmt.Sprintf("Imported batch of %d documents. Total imported: %d", len(batchRefs), imported))
+		batch = s.firestoreClient.Batch()
+		batchRefs = []*firestore.DocumentRef{}
+		return nil
+	}
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var line ExportedDocument
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("failed to parse line %d: %v", lineNumber, err)
+		}
+
+		ref := s.firestoreClient.Doc(line.Path)
+		if ref == nil {
+			return fmt.Errorf("invalid document path on line %d: %s", lineNumber, line.Path)
+		}
+		data, err := s.decodeFields(line.Fields)
+		if err != nil {
+			return fmt.Errorf("failed to decode document %s: %v", line.Path, err)
+		}
+
+		batch.Set(ref, data)
+		batchRefs = append(batchRefs, ref)
+		if len(batchRefs) == transferBatchSize {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read import file: %v", err)
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+
+	logger.LogInfoWithFields("Completed import", logrus.Fields{"Documents": imported, "BackupRunId": backupRun.RunId})
+	return nil
+}
+
+func encodeFields(data map[string]interface{}) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage, len(data))
+	for key, value := range data {
+		encoded, err := encodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", key, err)
+		}
+		fields[key] = encoded
+	}
+	return fields, nil
+}
+
+func encodeValue(value interface{}) (json.RawMessage, error) {
+	var typed map[string]interface{}
+
+	switch v := value.(type) {
+	case nil:
+		typed = map[string]interface{}{"nullValue": nil}
+	case bool:
+		typed = map[string]interface{}{"booleanValue": v}
+	case int64:
+		// Integers are strings so 64-bit values survive JSON round trips
+		typed = map[string]interface{}{"integerValue": strconv.FormatInt(v, 10)}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			typed = map[string]interface{}{"doubleValue": strconv.FormatFloat(v, 'g', -1, 64)}
+		} else {
+			typed = map[string]interface{}{"doubleValue": v}
+		}
+	case string:
+		typed = map[string]interface{}{"stringValue": v}
+	case []byte:
+		typed = map[string]interface{}{"bytesValue": base64.StdEncoding.EncodeToString(v)}
+	case time.Time:
+		typed = map[string]interface{}{"timestampValue": v.UTC().Format(time.RFC3339Nano)}
+	case *latlng.LatLng:
+		typed = map[string]interface{}{"geoPointValue": map[string]float64{"latitude": v.GetLatitude(), "longitude": v.GetLongitude()}}
+	case *firestore.DocumentRef:
+		if v == nil {
+			typed = map[string]interface{}{"nullValue": nil}
+		} else {
+			typed = map[string]interface{}{"referenceValue": relativeDocumentPath(v)}
+		}
+	case []interface{}:
+		values := make([]json.RawMessage, len(v))
+		for i, element := range v {
+			encoded, err := encodeValue(element)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = encoded
+		}
+		typed = map[string]interface{}{"arrayValue": values}
+	case map[string]interface{}:
+		fields, err := encodeFields(v)
+		if err != nil {
+			return nil, err
+		}
+		typed = map[string]interface{}{"mapValue": fields}
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", v)
+	}
+
+	return json.Marshal(typed)
+}
+
+func (s *CollectionTransferService) decodeFields(fields map[string]json.RawMessage) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(fields))
+	for key, raw := range fields {
+		value, err := s.decodeValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", key, err)
+		}
+		data[key] = value
+	}
+	return data, nil
+}
+
+func (s *CollectionTransferService) decodeValue(raw json.RawMessage) (interface{}, error) {
+	var typed map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &typed); err != nil {
+		return nil, err
+	}
+	if len(typed) != 1 {
+		return nil, fmt.Errorf("expected exactly one value type, got %d", len(typed))
+	}
+
+	for valueType, payload := range typed {
+		switch valueType {
+		case "nullValue":
+			return nil, nil
+		case "booleanValue":
+			var v bool
+			err := json.Unmarshal(payload, &v)
+			return v, err
+		case "integerValue":
+			var v string
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return nil, err
+			}
+			return strconv.ParseInt(v, 10, 64)
+		case "doubleValue":
+			var v float64
+			if err := json.Unmarshal(payload, &v); err == nil {
+				return v, nil
+			}
+			var special string
+			if err := json.Unmarshal(payload, &special); err != nil {
+				return nil, err
+			}
+			return strconv.ParseFloat(special, 64)
+		case "stringValue":
+			var v string
+			err := json.Unmarshal(payload, &v)
+			return v, err
+		case "bytesValue":
+			var v string
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return nil, err
+			}
+			return base64.StdEncoding.DecodeString(v)
+		case "timestampValue":
+			var v string
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return nil, err
+			}
+			return time.Parse(time.RFC3339Nano, v)
+		case "geoPointValue":
+			var v struct {
+				Latitude  float64 `json:"latitude"`
+				Longitude float64 `json:"longitude"`
+			}
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return nil, err
+			}
+			return &latlng.LatLng{Latitude: v.Latitude, Longitude: v.Longitude}, nil
+		case "referenceValue":
+			var v string
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return nil, err
+			}
+			ref := s.firestoreClient.Doc(v)
+			if ref == nil {
+				return nil, fmt.Errorf("invalid reference path: %s", v)
+			}
+			return ref, nil
+		case "arrayValue":
+			var elements []json.RawMessage
+			if err := json.Unmarshal(payload, &elements); err != nil {
+				return nil, err
+			}
+			values := make([]interface{}, len(elements))
+			for i, element := range elements {
+				value, err := s.decodeValue(element)
+				if err != nil {
+					return nil, err
+				}
+				values[i] = value
+			}
+			return values, nil
+		case "mapValue":
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(payload, &fields); err != nil {
+				return nil, err
+			}
+			return s.decodeFields(fields)
+		default:
+			return nil, fmt.Errorf("unknown value type %s", valueType)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// equalValues compares decoded Firestore values, treating NaNs as equal,
+// timestamps by instant and references by path.
+func equalValues(a, b interface{}) bool {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		return ok && (x == y || math.IsNaN(x) && math.IsNaN(y))
+	case time.Time:
+		y, ok := b.(time.Time)
+		return ok && x.Equal(y)
+	case []byte:
+		y, ok := b.([]byte)
+		return ok && string(x) == string(y)
+	case *latlng.LatLng:
+		y, ok := b.(*latlng.LatLng)
+		return ok && x.GetLatitude() == y.GetLatitude() && x.GetLongitude() == y.GetLongitude()
+	case *firestore.DocumentRef:
+		y, ok := b.(*firestore.DocumentRef)
+		if x == nil || !ok || y == nil {
+			return ok && x == y
+		}
+		return relativeDocumentPath(x) == relativeDocumentPath(y)
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equalValues(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			if other, found := y[key]; !found || !equalValues(value, other) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func TestCollectionTransferValueRoundTrip(t *testing.T) {
+	// The emulator address keeps the client from looking for credentials;
+	// building references never connects
+	t.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	client, err := firestore.NewClient(context.Background(), "wander-wallet-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	service := NewCollectionTransferService(client)
+
+	berlin := time.FixedZone("CET", 3600)
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{name: "null", value: nil},
+		{name: "boolean", value: true},
+		{name: "integer", value: int64(math.MaxInt64)},
+		{name: "negative integer", value: int64(-42)},
+		{name: "double", value: 1234.5678},
+		{name: "NaN", value: math.NaN()},
+		{name: "infinity", value: math.Inf(1)},
+		{name: "negative infinity", value: math.Inf(-1)},
+		{name: "string", value: "São Paulo ✈"},
+		{name: "bytes", value: []byte{0, 1, 2, 254, 255}},
+		{name: "timestamp", value: time.Date(2026, time.March, 7, 23, 30, 15, 123456789, berlin)},
+		{name: "geo point", value: &latlng.LatLng{Latitude: 38.7223, Longitude: -9.1393}},
+		{name: "reference", value: client.Doc("cost-of-living-stats/2026-01-01")},
+		{name: "array", value: []interface{}{int64(1), "two", 3.5, nil, []interface{}{false}}},
+		{name: "map", value: map[string]interface{}{
+			"city":     "Lisbon",
+			"location": &latlng.LatLng{Latitude: 38.7223, Longitude: -9.1393},
+			"scores":   map[string]interface{}{"overall": 42.5, "ranks": []interface{}{int64(3), math.NaN()}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := encodeValue(test.value)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			decoded, err := service.decodeValue(encoded)
+			if err != nil {
+				t.Fatalf("decode %s: %v", encoded, err)
+			}
+			if !equalValues(test.value, decoded) {
+				t.Errorf("%v encoded as %s decoded to %v", test.value, encoded, decoded)
+			}
+		})
+	}
+}
+
+func TestCollectionTransferNilReferenceIsNull(t *testing.T) {
+	encoded, err := encodeValue((*firestore.DocumentRef)(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != `{"nullValue":null}` {
+		t.Errorf("nil reference encoded as %s, expected a null value", encoded)
+	}
+}
+
+func TestCollectionTransferUnsupportedValue(t *testing.T) {
+	if _, err := encodeValue(struct{}{}); err == nil {
+		t.Error("expected an error for an unsupported type")
+	}
+}
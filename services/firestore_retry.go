@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+
+	"wander-wallet-tools/retry"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Thin wrappers that run single Firestore calls under the shared retry
+// policy. Streaming iterators are not wrapped because a failed stream cannot
+// be resumed by calling Next again.
+
+func getDocument(ctx context.Context, ref *firestore.DocumentRef) (*firestore.DocumentSnapshot, error) {
+	var doc *firestore.DocumentSnapshot
+	err := retry.Do(ctx, "get "+ref.Path, func(ctx context.Context) error {
+		var err error
+		doc, err = ref.Get(ctx)
+		return err
+	})
+	return doc, err
+}
+
+func getAllDocuments(ctx context.Context, client *firestore.Client, refs []*firestore.DocumentRef) ([]*firestore.DocumentSnapshot, error) {
+	var docs []*firestore.DocumentSnapshot
+	err := retry.Do(ctx, "get all documents", func(ctx context.Context) error {
+		var err error
+		docs, err = client.GetAll(ctx, refs)
+		return err
+	})
+	return docs, err
+}
+
+func queryAllDocuments(ctx context.Context, query firestore.Query) ([]*firestore.DocumentSnapshot, error) {
+	var docs []*firestore.DocumentSnapshot
+	err := retry.Do(ctx, "query documents", func(ctx context.Context) error {
+		var err error
+		docs, err = query.Documents(ctx).GetAll()
+		return err
+	})
+	return docs, err
+}
+
+func setDocument(ctx context.Context, ref *firestore.DocumentRef, data interface{}, opts ...firestore.SetOption) (*firestore.WriteResult, error) {
+	var result *firestore.WriteResult
+	err := retry.Do(ctx, "set "+ref.Path, func(ctx context.Context) error {
+		var err error
+		result, err = ref.Set(ctx, data, opts...)
+		return err
+	})
+	return result, err
+}
+
+func commitBatch(ctx context.Context, batch *firestore.WriteBatch) error {
+	return retry.Do(ctx, "commit batch", func(ctx context.Context) error {
+		_, err := batch.Commit(ctx)
+		return err
+	})
+}
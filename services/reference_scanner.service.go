@@ -0,0 +1,301 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+
+	"wander-wallet-tools/logger"
+	"wander-wallet-tools/utils"
+
+	"cloud.google.com/go/firestore"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	IssueDanglingRef         = "dangling-ref"
+	IssueOrphanedDoc         = "orphaned-doc"
+	IssueUnmappedDestination = "unmapped-destination"
+)
+
+type ReferenceIssue struct {
+	Kind   string
+	Path   string
+	Field  string
+	Target string
+}
+
+type ReferenceScanOptions struct {
+	NullDanglingRefs bool
+	DeleteOrphans    bool
+}
+
+// ReferenceScannerService checks the links between location-mappings,
+// top-destinations and cost-of-living-analytics and the documents they
+// point at.
+type ReferenceScannerService struct {
+	firestoreClient *firestore.Client
+}
+
+func NewReferenceScannerService(firestoreClient *firestore.Client) *ReferenceScannerService {
+	return &ReferenceScannerService{
+		firestoreClient: firestoreClient,
+	}
+}
+
+// ScanReferences reports location mapping refs whose target document does not
+// exist, analytics docs whose cost-of-living source is gone, and top
+// destinations without a location mapping. Dangling refs can be set to null
+// and orphaned analytics docs deleted; both changes are backed up first.
+func (s *ReferenceScannerService) ScanReferences(ctx context.Context, options ReferenceScanOptions) ([]ReferenceIssue, error) {
+	logger.LogInfoLn("Starting reference scan")
+
+	var issues []ReferenceIssue
+
+	mappingDocs, err := queryAllDocuments(ctx, s.firestoreClient.Collection("location-mappings").Query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read location mappings: %v", err)
+	}
+
+	mappingIssues, err := s.scanLocationMappings(ctx, mappingDocs)
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, mappingIssues...)
+
+	analyticsIssues, err := s.scanAnalytics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, analyticsIssues...)
+
+	destinationIssues, err := s.scanTopDestinations(ctx, mappingDocs)
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, destinationIssues...)
+
+	if err := s.writeIssuesCSV("reference_scan_report.csv", issues); err != nil {
+		return issues, err
+	}
+
+	if options.NullDanglingRefs || options.DeleteOrphans {
+		if err := s.fixIssues(ctx, issues, options); err != nil {
+			return issues, err
+		}
+	}
+
+	logger.LogInfoWithFields("Completed reference scan", logrus.Fields{
+		"DanglingRefs":         len(mappingIssues),
+		"OrphanedAnalytics":    len(analyticsIssues),
+		"UnmappedDestinations": len(destinationIssues),
+	})
+	return issues, nil
+}
+
+func (s *ReferenceScannerService) scanLocationMappings(ctx context.Context, docs []*firestore.DocumentSnapshot) ([]ReferenceIssue, error) {
+	type pendingRef struct {
+		path  string
+		field string
+		ref   *firestore.DocumentRef
+	}
+	var pending []pendingRef
+	for _, doc := range docs {
+		data := doc.Data()
+		for _, field := range locationMappingRefFields {
+			if ref, ok := data[field].(*firestore.DocumentRef); ok && ref != nil {
+				pending = append(pending, pendingRef{path: relativeDocumentPath(doc.Ref), field: field, ref: ref})
+			}
+		}
+	}
+
+	refs := make([]*firestore.DocumentRef, len(pending))
+	for i, p := range pending {
+		refs[i] = p.ref
+	}
+	exists, err := s.documentsExist(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	var issues []ReferenceIssue
+	for i, p := range pending {
+		if !exists[i] {
+			issues = append(issues, ReferenceIssue{Kind: IssueDanglingRef, Path: p.path, Field: p.field, Target: relativeDocumentPath(p.ref)})
+		}
+	}
+	return issues, nil
+}
+
+func (s *ReferenceScannerService) scanAnalytics(ctx context.Context) ([]ReferenceIssue, error) {
+	docs, err := queryAllDocuments(ctx, s.firestoreClient.Collection("cost-of-living-analytics").Query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cost of living analytics: %v", err)
+	}
+
+	sources := make([]*firestore.DocumentRef, len(docs))
+	for i, doc := range docs {
+		sources[i] = s.firestoreClient.Collection("cost-of-living").Doc(doc.Ref.ID)
+	}
+	exists, err := s.documentsExist(ctx, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	var issues []ReferenceIssue
+	for i, doc := range docs {
+		if !exists[i] {
+			issues = append(issues, ReferenceIssue{Kind: IssueOrphanedDoc, Path: relativeDocumentPath(doc.Ref), Target: relativeDocumentPath(sources[i])})
+		}
+	}
+	return issues, nil
+}
+
+// scanTopDestinations matches destinations to mappings the same way the
+// enrichment service does: by the city-country document ID, or by the city
+// and country fields of a mapping stored under a longer standard name.
+func (s *ReferenceScannerService) scanTopDestinations(ctx context.Context, mappingDocs []*firestore.DocumentSnapshot) ([]ReferenceIssue, error) {
+	docs, err := queryAllDocuments(ctx, s.firestoreClient.Collection("top-destinations").Query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read top destinations: %v", err)
+	}
+
+	mapped := make(map[string]bool)
+	for _, doc := range mappingDocs {
+		mapped[doc.Ref.ID] = true
+		city := utils.GetString(doc.Data(), "city")
+		country := utils.GetString(doc.Data(), "country")
+		mapped[fmt.Sprintf("%s-%s", utils.NormalizeAndFormat(city), utils.NormalizeAndFormat(country))] = true
+	}
+
+	var issues []ReferenceIssue
+	for _, doc := range docs {
+		city := utils.GetString(doc.Data(), "city")
+		country := utils.GetString(doc.Data(), "country")
+		mappingId := fmt.Sprintf("%s-%s", utils.NormalizeAndFormat(city), utils.NormalizeAndFormat(country))
+		if !mapped[mappingId] {
+			issues = append(issues, ReferenceIssue{Kind: IssueUnmappedDestination, Path: relativeDocumentPath(doc.Ref), Target: "location-mappings/" + mappingId})
+		}
+	}
+	return issues, nil
+}
+
+func (s *ReferenceScannerService) documentsExist(ctx context.Context, refs []*firestore.DocumentRef) ([]bool, error) {
+	exists := make([]bool, len(refs))
+	for i := 0; i < len(refs); i += transferBatchSize {
+		end := i + transferBatchSize
+		if end > len(refs) {
+			end = len(refs)
+		}
+
+		docs, err := getAllDocuments(ctx, s.firestoreClient, refs[i:end])
+		if err != nil {
+			return nil, fmt.Errorf("failed to check referenced documents: %v", err)
+		}
+		for j, doc := range docs {
+			exists[i+j] = doc.Exists()
+		}
+	}
+	return exists, nil
+}
+
+func (s *ReferenceScannerService) fixIssues(ctx context.Context, issues []ReferenceIssue, options ReferenceScanOptions) error {
+	backupRun, err := NewBackupService(s.firestoreClient).StartRun(ctx, "fix-references")
+	if err != nil {
+		return err
+	}
+
+	// Group dangling fields per mapping so each document gets one update
+	danglingFields := make(map[string][]string)
+	var orphans []*firestore.DocumentRef
+	for _, issue := range issues {
+		switch {
+		case issue.Kind == IssueDanglingRef && options.NullDanglingRefs:
+			danglingFields[issue.Path] = append(danglingFields[issue.Path], issue.Field)
+		case issue.Kind == IssueOrphanedDoc && options.DeleteOrphans:
+			orphans = append(orphans, s.firestoreClient.Doc(issue.Path))
+		}
+	}
+
+	var affected []*firestore.DocumentRef
+	for path := range danglingFields {
+		affected = append(affected, s.firestoreClient.Doc(path))
+	}
+	affected = append(affected, orphans...)
+	if err := backupRun.Capture(ctx, affected...); err != nil {
+		return err
+	}
+
+	batch := s.firestoreClient.Batch()
+	batchSize := 0
+	for path, fields := range danglingFields {
+		updates := make([]firestore.Update, len(fields))
+		for i, field := range fields {
+			updates[i] = firestore.Update{Path: field, Value: nil}
+		}
+		batch.Update(s.firestoreClient.Doc(path), updates)
+		batchSize++
+		if batchSize == transferBatchSize {
+			if err := commitBatch(ctx, batch); err != nil {
+				return fmt.Errorf("failed to remove dangling refs: %v", err)
+			}
+			batch = s.firestoreClient.Batch()
+			batchSize = 0
+		}
+	}
+	for _, ref := range orphans {
+		batch.Delete(ref)
+		batchSize++
+		if batchSize == transferBatchSize {
+			if err := commitBatch(ctx, batch); err != nil {
+				return fmt.Errorf("failed to delete orphaned documents: %v", err)
+			}
+			batch = s.firestoreClient.Batch()
+			batchSize = 0
+		}
+	}
+	if batchSize > 0 {
+		if err := commitBatch(ctx, batch); err != nil {
+			return fmt.Errorf("failed to apply reference fixes: %v", err)
+		}
+	}
+
+	logger.LogInfoWithFields("Applied reference fixes", logrus.Fields{
+		"MappingsUpdated": len(danglingFields),
+		"OrphansDeleted":  len(orphans),
+		"BackupRunId":     backupRun.RunId,
+	})
+	return nil
+}
+
+func (s *ReferenceScannerService) writeIssuesCSV(filename string, issues []ReferenceIssue) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	headers := []string{"Issue", "Document", "Field", "Target"}
+	if err := writer.Write(headers); err != nil {
+		return fmt.Errorf("error writing CSV headers: %v", err)
+	}
+
+	for _, issue := range issues {
+		if err := writer.Write([]string{issue.Kind, issue.Path, issue.Field, issue.Target}); err != nil {
+			return fmt.Errorf("error writing CSV row: %v", err)
+		}
+	}
+	return nil
+}
+
+var locationMappingRefFields = []string{
+	"citySafetyRef",
+	"countrySafetyRef",
+	"internetSpeedRef",
+	"costOfLivingRef",
+	"costOfLivingAnalyticsRef",
+}
@@ -14,6 +14,7 @@ import (
 	"wander-wallet-tools/config"
 	"wander-wallet-tools/logger"
 	"wander-wallet-tools/models"
+	"wander-wallet-tools/retry"
 	"wander-wallet-tools/utils"
 
 	"cloud.google.com/go/bigquery"
@@ -38,6 +39,7 @@ type TopDestinationEnrichmentService struct {
 	cfg             *config.Config
 	mapsClient      *maps.Client
 	bigqueryClient  *bigquery.Client
+	backupRun       *BackupRun
 }
 
 func NewTopDestinationEnrichmentService(bigqueryClient *bigquery.Client, client *firestore.Client, cfg *config.Config, mapsClient *maps.Client) *TopDestinationEnrichmentService {
@@ -50,6 +52,13 @@ func NewTopDestinationEnrichmentService(bigqueryClient *bigquery.Client, client
 }
 
 func (s *TopDestinationEnrichmentService) EnrichTopDestinations(ctx context.Context) error {
+	backupRun, err := NewBackupService(s.firestoreClient).StartRun(ctx, "enrich-top-destinations")
+	if err != nil {
+		logger.LogErrorWithFields("Failed to start backup run", logrus.Fields{"Error": err.Error()})
+		return err
+	}
+	s.backupRun = backupRun
+
 	destinations, err := s.getTopDestinations(ctx)
 	if err != nil {
 		logger.LogErrorWithFields("Failed to fetch top destinations", logrus.Fields{"Error": err.Error()})
@@ -87,12 +96,13 @@ func (s *TopDestinationEnrichmentService) EnrichTopDestinations(ctx context.Cont
 		return err
 	}
 
+	logger.LogInfoWithFields("Completed enrichment of top destinations", logrus.Fields{"BackupRunId": backupRun.RunId})
 	return nil
 }
 
 func (s *TopDestinationEnrichmentService) getTopDestinations(ctx context.Context) ([]models.TopDestination, error) {
 	var destinations []models.TopDestination
-	docs, err := s.firestoreClient.Collection("top-destinations").OrderBy("rank", firestore.Asc).Offset(60).Limit(100).Documents(ctx).GetAll()
+	docs, err := queryAllDocuments(ctx, s.firestoreClient.Collection("top-destinations").OrderBy("rank", firestore.Asc).Offset(60).Limit(100))
 	if err != nil {
 		return nil, err
 	}
@@ -162,7 +172,7 @@ func (s *TopDestinationEnrichmentService) enrichDestination(ctx context.Context,
 	}
 
 	if mapping.CostOfLivingAnalyticsRef != nil {
-		colScore, err := s.getCostOfLivingScore(ctx, mapping.CostOfLivingAnalyticsRef)
+		analytics, err := s.getCostOfLivingAnalytics(ctx, mapping.CostOfLivingAnalyticsRef)
 		if err != nil {
 			logger.LogErrorWithFields("Failed to get cost of living score", logrus.Fields{
 				"Error":   err.Error(),
@@ -171,14 +181,15 @@ func (s *TopDestinationEnrichmentService) enrichDestination(ctx context.Context,
 			})
 			report.MissingCOL = true
 		} else {
-			dest.CostOfLivingScore = colScore
+			dest.CostOfLivingScore = analytics.Scores.Overall
+			dest.PriceTier = analytics.PriceTier
 		}
 	} else {
 		report.MissingCOL = true
 	}
 
 	if len(dest.Photos) == 0 {
-		photos, err := s.fetchPhotosFromPexels(dest.City + " " + dest.Country)
+		photos, err := s.fetchPhotosFromPexels(ctx, dest.City+" "+dest.Country)
 		if err != nil {
 			logger.LogErrorWithFields("Failed to fetch photos", logrus.Fields{
 				"Error":   err.Error(),
@@ -202,7 +213,7 @@ func (s *TopDestinationEnrichmentService) enrichDestination(ctx context.Context,
 
 func (s *TopDestinationEnrichmentService) getLocationMapping(ctx context.Context, dest models.TopDestination) (*models.LocationMapping, error) {
 	docId := fmt.Sprintf("%v-%s", utils.NormalizeAndFormat(dest.City), utils.NormalizeAndFormat(dest.Country))
-	docById, err := s.firestoreClient.Collection("location-mappings").Doc(docId).Get(ctx)
+	docById, err := getDocument(ctx, s.firestoreClient.Collection("location-mappings").Doc(docId))
 	if err != nil {
 		logger.LogErrorLn("failed to get location mapping by DocId: %v", err)
 	}
@@ -210,14 +221,13 @@ func (s *TopDestinationEnrichmentService) getLocationMapping(ctx context.Context
 	if docById.Exists() {
 		var mapping *models.LocationMapping
 		if err := docById.DataTo(&mapping); err != nil {
-			return nil, fmt.Errorf("failed to parse location mapping", err)
+			return nil, fmt.Errorf("failed to parse location mapping: %v", err)
 		}
-		mapping = s.enrichMapping(ctx, *mapping)
-		return mapping, nil
+		return s.enrichMapping(ctx, *mapping)
 	}
 
 	query := s.firestoreClient.Collection("location-mappings").Where("city", "==", dest.City).Where("country", "==", dest.Country)
-	docs, err := query.Documents(ctx).GetAll()
+	docs, err := queryAllDocuments(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query location mappings: %v", err)
 	}
@@ -225,7 +235,7 @@ func (s *TopDestinationEnrichmentService) getLocationMapping(ctx context.Context
 	if len(docs) == 0 {
 		mapping, err := s.createLocationMapping(ctx, dest)
 		if err != nil {
-			return nil, fmt.Errorf("no location mapping locatoin mapping was able to be created", err)
+			return nil, fmt.Errorf("no location mapping was able to be created: %v", err)
 		}
 
 		return mapping, nil
@@ -244,11 +254,10 @@ func (s *TopDestinationEnrichmentService) getLocationMapping(ctx context.Context
 		}
 	}
 
-	bestMapping = s.enrichMapping(ctx, *bestMapping)
-	return bestMapping, nil
+	return s.enrichMapping(ctx, *bestMapping)
 }
 
-func (s *TopDestinationEnrichmentService) enrichMapping(ctx context.Context, mapping models.LocationMapping) *models.LocationMapping {
+func (s *TopDestinationEnrichmentService) enrichMapping(ctx context.Context, mapping models.LocationMapping) (*models.LocationMapping, error) {
 	req := &maps.FindPlaceFromTextRequest{
 		Input:     fmt.Sprintf("%s, %s", mapping.City, mapping.Country),
 		InputType: maps.FindPlaceFromTextInputTypeTextQuery,
@@ -263,13 +272,13 @@ func (s *TopDestinationEnrichmentService) enrichMapping(ctx context.Context, map
 		},
 	}
 
-	resp, err := s.mapsClient.FindPlaceFromText(ctx, req)
+	resp, err := s.findPlaceFromText(ctx, req)
 	if err != nil {
-		return &mapping
+		return &mapping, nil
 	}
 
 	if len(resp.Candidates) == 0 {
-		return &mapping
+		return &mapping, nil
 	}
 
 	candidate := resp.Candidates[0]
@@ -288,11 +297,15 @@ func (s *TopDestinationEnrichmentService) enrichMapping(ctx context.Context, map
 	mapping.LastRequested = time.Now()
 
 	mapping = *s.createDocRefs(&mapping)
-	s.firestoreClient.Collection("location-mappings").Doc(mapping.Id).Set(ctx, mapping)
-	if err != nil {
-		return &mapping
+	mappingRef := s.firestoreClient.Collection("location-mappings").Doc(mapping.Id)
+	if err := s.backupRun.Capture(ctx, mappingRef); err != nil {
+		logger.LogErrorWithFields("Failed to back up location mapping", logrus.Fields{"Error": err.Error(), "DocID": mapping.Id})
+		return &mapping, nil
+	}
+	if _, err := setDocument(ctx, mappingRef, mapping); err != nil {
+		return nil, fmt.Errorf("failed to save location mapping: %v", err)
 	}
-	return &mapping
+	return &mapping, nil
 }
 
 func (s *TopDestinationEnrichmentService) createLocationMapping(ctx context.Context, topDest models.TopDestination) (*models.LocationMapping, error) {
@@ -310,7 +323,7 @@ func (s *TopDestinationEnrichmentService) createLocationMapping(ctx context.Cont
 		},
 	}
 
-	resp, err := s.mapsClient.FindPlaceFromText(ctx, req)
+	resp, err := s.findPlaceFromText(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("error finding place: %v", err)
 	}
@@ -341,7 +354,11 @@ func (s *TopDestinationEnrichmentService) createLocationMapping(ctx context.Cont
 		LastRequested:    time.Now(),
 	}
 	mapping = s.createDocRefs(mapping)
-	result, err := s.firestoreClient.Collection("location-mappings").Doc(mapping.Id).Set(ctx, mapping)
+	mappingRef := s.firestoreClient.Collection("location-mappings").Doc(mapping.Id)
+	if err := s.backupRun.Capture(ctx, mappingRef); err != nil {
+		return nil, fmt.Errorf("failed to back up location mapping: %v", err)
+	}
+	result, err := setDocument(ctx, mappingRef, mapping)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get internet speed document: %v", err)
 	}
@@ -374,6 +391,16 @@ func (s *TopDestinationEnrichmentService) createDocRefs(mapping *models.Location
 	return mapping
 }
 
+func (s *TopDestinationEnrichmentService) findPlaceFromText(ctx context.Context, req *maps.FindPlaceFromTextRequest) (maps.FindPlaceFromTextResponse, error) {
+	var resp maps.FindPlaceFromTextResponse
+	err := retry.Do(ctx, "find place "+req.Input, func(ctx context.Context) error {
+		var err error
+		resp, err = s.mapsClient.FindPlaceFromText(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
 func containsAdministrativeArea(types []string) bool {
 	for _, t := range types {
 		if t == "administrative_area_level_1" {
@@ -392,7 +419,7 @@ func extractStateOrProvince(formattedAddress string) string {
 }
 
 func (s *TopDestinationEnrichmentService) getInternetSpeed(ctx context.Context, mapping *models.LocationMapping) (*models.InternetSpeed, error) {
-	doc, err := mapping.InternetSpeedRef.Get(ctx)
+	doc, err := getDocument(ctx, mapping.InternetSpeedRef)
 	if err != nil {
 		logger.LogErrorLn("failed to get internet speed document: %v", err)
 	}
@@ -414,7 +441,7 @@ func (s *TopDestinationEnrichmentService) getInternetSpeed(ctx context.Context,
 }
 
 func (s *TopDestinationEnrichmentService) getSafetyScore(ctx context.Context, ref *firestore.DocumentRef) (*models.SafetyScore, error) {
-	doc, err := ref.Get(ctx)
+	doc, err := getDocument(ctx, ref)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get safety score document: %v", err)
 	}
@@ -427,27 +454,21 @@ func (s *TopDestinationEnrichmentService) getSafetyScore(ctx context.Context, re
 	return &safetyScore, nil
 }
 
-func (s *TopDestinationEnrichmentService) getCostOfLivingScore(ctx context.Context, ref *firestore.DocumentRef) (float64, error) {
-	doc, err := ref.Get(ctx)
+func (s *TopDestinationEnrichmentService) getCostOfLivingAnalytics(ctx context.Context, ref *firestore.DocumentRef) (*models.CostOfLivingAnalytics, error) {
+	doc, err := getDocument(ctx, ref)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get cost of living analytics document: %v", err)
-	}
-
-	data := doc.Data()
-	scores, ok := data["scores"].(map[string]interface{})
-	if !ok {
-		return 0, fmt.Errorf("invalid cost of living analytics data structure")
+		return nil, fmt.Errorf("failed to get cost of living analytics document: %v", err)
 	}
 
-	overallScore, ok := scores["overall"].(float64)
-	if !ok {
-		return 0, fmt.Errorf("invalid overall score in cost of living analytics")
+	var analytics models.CostOfLivingAnalytics
+	if err := doc.DataTo(&analytics); err != nil {
+		return nil, fmt.Errorf("invalid cost of living analytics data structure: %v", err)
 	}
 
-	return overallScore, nil
+	return &analytics, nil
 }
 
-func (s *TopDestinationEnrichmentService) fetchPhotosFromPexels(query string) ([]string, error) {
+func (s *TopDestinationEnrichmentService) fetchPhotosFromPexels(ctx context.Context, query string) ([]string, error) {
 	apiKey := s.cfg.PexelsAPIKey
 	if apiKey == "" {
 		return nil, fmt.Errorf("PEXELS_API_KEY not found in environment variables")
@@ -465,17 +486,6 @@ func (s *TopDestinationEnrichmentService) fetchPhotosFromPexels(query string) ([
 
 	req.Header.Set("Authorization", apiKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
-
 	var result struct {
 		Photos []struct {
 			Src struct {
@@ -484,8 +494,25 @@ func (s *TopDestinationEnrichmentService) fetchPhotosFromPexels(query string) ([
 		} `json:"photos"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("error decoding response: %v", err)
+	client := &http.Client{}
+	err = retry.Do(ctx, "search Pexels photos", func(ctx context.Context) error {
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("error making request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return retry.NewHTTPError(resp)
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("error decoding response: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	if len(result.Photos) < 2 {
@@ -512,7 +539,11 @@ func (s *TopDestinationEnrichmentService) fetchPhotosFromPexels(query string) ([
 }
 
 func (s *TopDestinationEnrichmentService) saveDestination(ctx context.Context, dest models.TopDestination) error {
-	_, err := s.firestoreClient.Collection("top-destinations").Doc(dest.Id).Set(ctx, dest)
+	destRef := s.firestoreClient.Collection("top-destinations").Doc(dest.Id)
+	if err := s.backupRun.Capture(ctx, destRef); err != nil {
+		return fmt.Errorf("failed to back up destination: %v", err)
+	}
+	_, err := setDocument(ctx, destRef, dest)
 	if err != nil {
 		return fmt.Errorf("failed to save destination: %v", err)
 	}
@@ -595,7 +626,11 @@ func (h *TopDestinationEnrichmentService) createAndSaveInternetSpeeds(ctx contex
 		stateOrProvince = extractStateOrProvince(mapping.FormattedAddress)
 	}
 	standardName := models.ConstructStandardName("", mapping.City, stateOrProvince, mapping.Country)
-	_, err := h.firestoreClient.Collection("internet-speed-cache").Doc(standardName).Set(ctx, mapping)
+	speedRef := h.firestoreClient.Collection("internet-speed-cache").Doc(standardName)
+	if err := h.backupRun.Capture(ctx, speedRef); err != nil {
+		return nil, fmt.Errorf("failed to back up internet speed: %v", err)
+	}
+	_, err := setDocument(ctx, speedRef, mapping)
 	if err != nil {
 		return nil, fmt.Errorf("failed to save internet score: %v", err)
 	}
@@ -608,29 +643,31 @@ func (h *TopDestinationEnrichmentService) getSpeedAvg(ctx context.Context, forma
 	query := buildQuery(formattedAddress, boundaries, types, isDownload)
 
 	q := h.bigqueryClient.Query(query)
-	job, err := q.Run(ctx)
-	if err != nil {
-		return 0, fmt.Errorf("failed to execute BigQuery: %v", err)
-	}
-	status, err := job.Wait(ctx)
-	if err != nil {
-		return 0, fmt.Errorf("failed to execute BigQuery: %v", err)
-	}
-	if err := status.Err(); err != nil {
-		return 0, fmt.Errorf("failed to execute BigQuery: %v", err)
-	}
-	it, err := job.Read(ctx)
-	if err != nil {
-		return 0, fmt.Errorf("failed to execute BigQuery: %v", err)
-	}
 
 	var row struct{ Avg float64 }
-	err = it.Next(&row)
+	err := retry.Do(ctx, "query M-Lab speed averages", func(ctx context.Context) error {
+		job, err := q.Run(ctx)
+		if err != nil {
+			return err
+		}
+		status, err := job.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		if err := status.Err(); err != nil {
+			return err
+		}
+		it, err := job.Read(ctx)
+		if err != nil {
+			return err
+		}
+		return it.Next(&row)
+	})
 	if err == iterator.Done {
 		return 0, fmt.Errorf("no results found")
 	}
 	if err != nil {
-		return 0, fmt.Errorf("failed to get BigQuery result: %v", err)
+		return 0, fmt.Errorf("failed to execute BigQuery: %v", err)
 	}
 
 	return row.Avg, nil